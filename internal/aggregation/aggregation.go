@@ -0,0 +1,151 @@
+package aggregation
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// Statistics of the points of a window
+const (
+	Min   = "min"
+	Max   = "max"
+	Avg   = "avg"
+	Last  = "last"
+	Count = "count"
+)
+
+// Rule collapses the points of the matching metrics into statistics every window
+type Rule struct {
+	Pattern string
+	Window  time.Duration
+	Stats   []string
+
+	pattern glob.Glob
+}
+
+// Rules list of aggregation rules, the first matching rule applies
+type Rules []*Rule
+
+// Parse parses 'pattern=window' or 'pattern=window:stat+stat' rules, the default statistic is avg
+func Parse(entries []string) (Rules, error) {
+	var rules Rules
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		rule, err := parseRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregation '%s': %v", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRule(entry string) (*Rule, error) {
+	pattern, window, err := utils.SplitPair(entry, "pattern=window:stats")
+	if err != nil {
+		return nil, err
+	}
+
+	rule := &Rule{Pattern: pattern, Stats: []string{Avg}}
+	if idx := strings.Index(window, ":"); idx >= 0 {
+		rule.Stats = strings.Split(window[idx+1:], "+")
+		window = window[:idx]
+	}
+
+	if rule.Window, err = time.ParseDuration(window); err != nil {
+		return nil, err
+	}
+	if rule.Window < time.Second {
+		return nil, fmt.Errorf("the window must be at least 1s")
+	}
+
+	for i, stat := range rule.Stats {
+		stat = strings.TrimSpace(stat)
+		switch stat {
+		case Min, Max, Avg, Last, Count:
+		default:
+			return nil, fmt.Errorf("'%s' is not a valid statistic (%s, %s, %s, %s or %s)", stat, Min, Max, Avg, Last, Count)
+		}
+		rule.Stats[i] = stat
+	}
+
+	if rule.pattern, err = glob.Compile(rule.Pattern); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// Match returns the first rule matching the metric name, nil if the metric isn't aggregated
+func (rs Rules) Match(name string) *Rule {
+	for _, r := range rs {
+		if r.pattern.Match(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Name returns the name of a statistic, a single statistic keeps the metric name
+func (r *Rule) Name(name, stat string) string {
+	if len(r.Stats) == 1 {
+		return name
+	}
+	return name + "." + stat
+}
+
+// Series accumulates the points of a metric during a window
+type Series struct {
+	Name   string
+	Source string
+	Tags   map[string]string
+
+	min   float64
+	max   float64
+	sum   float64
+	last  float64
+	count int64
+	ts    int64
+}
+
+// Add adds a point, the timestamp of the window is the one of its latest point
+func (s *Series) Add(value float64, ts int64) {
+	if s.count == 0 {
+		s.min, s.max = value, value
+	}
+	s.min = math.Min(s.min, value)
+	s.max = math.Max(s.max, value)
+	s.sum += value
+	s.count++
+	if ts >= s.ts {
+		s.last = value
+		s.ts = ts
+	}
+}
+
+// Timestamp returns the timestamp of the latest point
+func (s *Series) Timestamp() int64 {
+	return s.ts
+}
+
+// Value returns a statistic of the points
+func (s *Series) Value(stat string) float64 {
+	switch stat {
+	case Min:
+		return s.min
+	case Max:
+		return s.max
+	case Last:
+		return s.last
+	case Count:
+		return float64(s.count)
+	default:
+		return s.sum / float64(s.count)
+	}
+}
@@ -0,0 +1,52 @@
+package aggregation_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/aggregation"
+)
+
+func TestParse(t *testing.T) {
+	rules, err := aggregation.Parse([]string{"pcf.container.*=1m:min+max+avg", " ", "pcf.*.latency.ms = 30s"})
+	assert.Nil(t, err)
+	assert.Len(t, rules, 2)
+
+	assert.Equal(t, time.Minute, rules[0].Window)
+	assert.Equal(t, []string{aggregation.Min, aggregation.Max, aggregation.Avg}, rules[0].Stats)
+	assert.Equal(t, 30*time.Second, rules[1].Window)
+	assert.Equal(t, []string{aggregation.Avg}, rules[1].Stats)
+
+	assert.Same(t, rules[0], rules.Match("pcf.container.rep.memory_bytes"))
+	assert.Same(t, rules[1], rules.Match("pcf.gorouter.route.latency.ms"))
+	assert.Nil(t, rules.Match("pcf.gorouter.requests"))
+
+	assert.Equal(t, "pcf.container.rep.memory_bytes.max", rules[0].Name("pcf.container.rep.memory_bytes", aggregation.Max))
+	assert.Equal(t, "pcf.gorouter.route.latency.ms", rules[1].Name("pcf.gorouter.route.latency.ms", aggregation.Avg))
+
+	for _, entry := range []string{"pcf.*", "pcf.*=1m:median", "pcf.*=forever", "pcf.*=100ms", "pcf.[*=1m"} {
+		_, err := aggregation.Parse([]string{entry})
+		assert.NotNil(t, err, entry)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	s := &aggregation.Series{}
+	s.Add(4, 20)
+	s.Add(1, 10)
+	s.Add(7, 30)
+	s.Add(-2, 40)
+
+	assert.Equal(t, -2.0, s.Value(aggregation.Min))
+	assert.Equal(t, 7.0, s.Value(aggregation.Max))
+	assert.Equal(t, 2.5, s.Value(aggregation.Avg))
+	assert.Equal(t, -2.0, s.Value(aggregation.Last))
+	assert.Equal(t, 4.0, s.Value(aggregation.Count))
+	assert.Equal(t, int64(40), s.Timestamp())
+
+	// a late point doesn't replace the last value
+	s.Add(100, 15)
+	assert.Equal(t, -2.0, s.Value(aggregation.Last))
+	assert.Equal(t, 100.0, s.Value(aggregation.Max))
+}
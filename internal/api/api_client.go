@@ -1,11 +1,14 @@
 package api
 
 import (
+	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
 
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/uaa"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
 )
 
@@ -14,11 +17,13 @@ type Client interface {
 	AppByGuid(guid string) (cfclient.App, error)
 	NewAppInfo(app cfclient.App) *AppInfo
 	GetApp(guid string) *AppInfo
+	AppGuidsByName(names []string) ([]string, error)
 }
 
 // APIClient wrapper for Cloud Foundry Client
 type APIClient struct {
 	client    *cfclient.Client
+	uaa       uaa.UAA
 	appsCahce *appsCache
 }
 
@@ -48,29 +53,43 @@ func (api *APIClient) NewAppInfo(app cfclient.App) *AppInfo {
 }
 
 // NewAPIClient crate a new ApiClient
-func NewAPIClient(nozzleConfig *config.NozzleConfig) (*APIClient, error) {
+func NewAPIClient(nozzleConfig *config.NozzleConfig, internalTags map[string]string) (*APIClient, error) {
 	apiURL := strings.Trim(nozzleConfig.APIURL, " ")
 	if !isValidURL(apiURL) {
 		apiURL = "https://" + apiURL
 	}
 
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: nozzleConfig.TLS.Clone(),
+	}
 	client, err := cfclient.NewClient(&cfclient.Config{
 		ApiAddress:        apiURL,
 		ClientID:          nozzleConfig.Username,
 		ClientSecret:      nozzleConfig.Password,
-		SkipSslValidation: true,
+		SkipSslValidation: nozzleConfig.SkipSSL,
+		HttpClient:        &http.Client{Transport: transport},
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	tokens, err := uaa.NewUAA(client.Endpoint.TokenEndpoint, nozzleConfig.Username, nozzleConfig.Password, nozzleConfig.TLS, internalTags)
+	if err != nil {
+		return nil, err
+	}
+
+	// replace the cfclient oauth2 client, so the CF API shares the cached UAA token
+	client.Config.HttpClient = &http.Client{Transport: &uaa.Transport{UAA: tokens, Base: transport}}
+
 	api := &APIClient{
 		client: client,
+		uaa:    tokens,
 	}
 
 	if nozzleConfig.EnableAppCache {
 		utils.Logger.Printf("Enabling App Cache")
-		api.appsCahce = prepareAppsCache(api, nozzleConfig)
+		api.appsCahce = prepareAppsCache(api, nozzleConfig, internalTags)
 	} else {
 		utils.Logger.Printf("App Cache Disabled")
 	}
@@ -83,13 +102,14 @@ func (api *APIClient) FetchTrafficControllerURL() string {
 	return api.client.Endpoint.DopplerEndpoint
 }
 
-// FetchAuthToken wrapper for client.GetToken()
+// FetchAuthToken returns the cached UAA token
 func (api *APIClient) FetchAuthToken() (string, error) {
-	token, err := api.client.GetToken()
-	if err != nil {
-		return "", err
-	}
-	return token, nil
+	return api.uaa.GetAuthToken()
+}
+
+// TokenProvider returns the UAA token provider shared by the CF API client
+func (api *APIClient) TokenProvider() uaa.UAA {
+	return api.uaa
 }
 
 func (api *APIClient) ListApps() map[string]*AppInfo {
@@ -104,6 +124,24 @@ func (api *APIClient) ListApps() map[string]*AppInfo {
 	return appsInfo
 }
 
+// AppGuidsByName returns the guids of the apps with the given names
+func (api *APIClient) AppGuidsByName(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	apps, err := api.client.ListAppsByQuery(url.Values{"q": {"name IN " + strings.Join(names, ",")}})
+	if err != nil {
+		return nil, fmt.Errorf("error getting apps by name: %v", err)
+	}
+
+	var guids []string
+	for _, app := range apps {
+		guids = append(guids, app.Guid)
+	}
+	return guids, nil
+}
+
 // GetApp return cached AppInfo for a guid
 func (api *APIClient) GetApp(guid string) *AppInfo {
 	return api.appsCahce.getApp(guid)
@@ -42,3 +42,7 @@ func (api *MockApiClient) GetApp(guid string) *AppInfo {
 	atomic.AddInt64(&api.GetAppCallCount, 1)
 	return nil
 }
+
+func (api *MockApiClient) AppGuidsByName(names []string) ([]string, error) {
+	return nil, nil
+}
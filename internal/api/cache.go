@@ -21,8 +21,7 @@ type appsCache struct {
 	preloading bool
 }
 
-func prepareAppsCache(api Client, conf *config.NozzleConfig) *appsCache {
-	internalTags := utils.GetInternalTags()
+func prepareAppsCache(api Client, conf *config.NozzleConfig, internalTags map[string]string) *appsCache {
 	apps := &appsCache{
 		cache:      cache.New(conf.AppCacheExpiration, time.Hour),
 		errors:     utils.NewCounter("cache.errors", internalTags),
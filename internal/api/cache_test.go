@@ -11,7 +11,7 @@ import (
 func TestCacheCallsPreLoadingOnce(t *testing.T) {
 	nozzleConfig := &config.NozzleConfig{}
 	mockApiClient := NewMockApiClient()
-	appCache := prepareAppsCache(mockApiClient, nozzleConfig)
+	appCache := prepareAppsCache(mockApiClient, nozzleConfig, nil)
 
 	for atomic.LoadInt64(&mockApiClient.ListAppsCallCount) == int64(0) {
 		time.Sleep(time.Duration(10 * time.Millisecond))
@@ -30,7 +30,7 @@ func TestCacheCallsPreLoadingOnce(t *testing.T) {
 func TestCacheDoesntDoLookupsWhilePreloading(t *testing.T) {
 	nozzleConfig := &config.NozzleConfig{}
 	mockApiClient := NewMockApiClient()
-	appCache := prepareAppsCache(mockApiClient, nozzleConfig)
+	appCache := prepareAppsCache(mockApiClient, nozzleConfig, nil)
 
 	for atomic.LoadInt64(&mockApiClient.ListAppsCallCount) == int64(0) {
 		time.Sleep(time.Duration(10 * time.Millisecond))
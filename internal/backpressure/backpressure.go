@@ -0,0 +1,134 @@
+package backpressure
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// Overflow policies
+const (
+	DropNewest = "drop-newest"
+	DropOldest = "drop-oldest"
+	Block      = "block"
+	Sample     = "sample"
+)
+
+// Queue is a bounded queue, usually a wrapped channel
+type Queue interface {
+	Offer(item interface{}) bool
+	// OfferTimeout waits up to 'timeout' for room on the queue, a timeout <= 0 waits until there is room
+	OfferTimeout(item interface{}, timeout time.Duration) bool
+	Poll() (interface{}, bool)
+	Len() int
+	Cap() int
+}
+
+// Policy decides what to do with the items that don't fit on a full queue
+type Policy struct {
+	name     string
+	timeout  time.Duration
+	kind     func(item interface{}) string
+	overflow func(item interface{}) bool
+
+	drops       metrics.Counter
+	tags        map[string]string
+	mutex       sync.Mutex
+	dropsByType map[string]metrics.Counter
+}
+
+// New creates a Policy, a block 'timeout' <= 0 blocks until there is room, 'kind' returns the item type used to break down the drops, reported with 'tags'
+func New(name string, timeout time.Duration, kind func(item interface{}) string, drops metrics.Counter, tags map[string]string) (*Policy, error) {
+	switch name {
+	case DropNewest, DropOldest, Block, Sample:
+	default:
+		return nil, fmt.Errorf("'%s' is not a valid queue policy (%s, %s, %s or %s)", name, DropNewest, DropOldest, Block, Sample)
+	}
+
+	return &Policy{
+		name:        name,
+		timeout:     timeout,
+		kind:        kind,
+		drops:       drops,
+		tags:        tags,
+		dropsByType: make(map[string]metrics.Counter),
+	}, nil
+}
+
+// SetOverflow sets a handler that takes the items of a full queue before the policy is applied
+func (p *Policy) SetOverflow(overflow func(item interface{}) bool) {
+	p.overflow = overflow
+}
+
+// Name returns the policy name
+func (p *Policy) Name() string {
+	return p.name
+}
+
+// Enqueue puts the item on the queue, returns false if the item was dropped
+func (p *Policy) Enqueue(q Queue, item interface{}) bool {
+	if p.name == Sample && !p.sample(q) {
+		p.drop(item)
+		return false
+	}
+
+	if q.Offer(item) {
+		return true
+	}
+
+	if p.overflow != nil && p.overflow(item) {
+		return true
+	}
+
+	switch p.name {
+	case Block:
+		if q.OfferTimeout(item, p.timeout) {
+			return true
+		}
+	case DropOldest:
+		if oldest, ok := q.Poll(); ok {
+			p.drop(oldest)
+		}
+		if q.Offer(item) {
+			return true
+		}
+	}
+
+	p.drop(item)
+	return false
+}
+
+// sample keeps every item while the queue is less than half full, then the
+// probability of keeping an item decreases linearly down to 0 when the queue is full
+func (p *Policy) sample(q Queue) bool {
+	if q.Cap() == 0 {
+		return true
+	}
+	fill := float64(q.Len()) / float64(q.Cap())
+	if fill < 0.5 {
+		return true
+	}
+	return rand.Float64() < (1-fill)*2
+}
+
+func (p *Policy) drop(item interface{}) {
+	p.drops.Inc(1)
+
+	kind := p.kind(item)
+	p.mutex.Lock()
+	counter, ok := p.dropsByType[kind]
+	if !ok {
+		tags := utils.CopyTags(p.tags)
+		tags["type"] = kind
+		tags["policy"] = p.name
+		counter = utils.NewCounter("nozzle.queue.drops_by_type", tags)
+		p.dropsByType[kind] = counter
+	}
+	p.mutex.Unlock()
+
+	counter.Inc(1)
+}
@@ -0,0 +1,139 @@
+package backpressure_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/backpressure"
+)
+
+func kind(item interface{}) string { return "test" }
+
+func newPolicy(t *testing.T, name string) (*backpressure.Policy, metrics.Counter) {
+	drops := metrics.NewCounter()
+	p, err := backpressure.New(name, 10*time.Millisecond, kind, drops, nil)
+	if err != nil {
+		assert.FailNow(t, "unable to create policy: ", err)
+	}
+	return p, drops
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	_, err := backpressure.New("drop-everything", 0, kind, metrics.NewCounter(), nil)
+	assert.Error(t, err)
+}
+
+func TestDropNewest(t *testing.T) {
+	p, drops := newPolicy(t, backpressure.DropNewest)
+	ch := make(chan int, 2)
+	q := backpressure.NewChanQueue(ch)
+
+	assert.True(t, p.Enqueue(q, 1))
+	assert.True(t, p.Enqueue(q, 2))
+	assert.False(t, p.Enqueue(q, 3))
+	assert.Equal(t, int64(1), drops.Count())
+	assert.Equal(t, 1, <-ch)
+}
+
+func TestDropOldest(t *testing.T) {
+	p, drops := newPolicy(t, backpressure.DropOldest)
+	ch := make(chan int, 2)
+	q := backpressure.NewChanQueue(ch)
+
+	p.Enqueue(q, 1)
+	p.Enqueue(q, 2)
+	assert.True(t, p.Enqueue(q, 3))
+	assert.Equal(t, int64(1), drops.Count())
+	assert.Equal(t, 2, <-ch)
+	assert.Equal(t, 3, <-ch)
+}
+
+func TestBlock(t *testing.T) {
+	p, drops := newPolicy(t, backpressure.Block)
+	ch := make(chan int, 1)
+	q := backpressure.NewChanQueue(ch)
+
+	p.Enqueue(q, 1)
+	go func() {
+		time.Sleep(time.Millisecond)
+		<-ch
+	}()
+	assert.True(t, p.Enqueue(q, 2))
+	assert.False(t, p.Enqueue(q, 3), "timeout expired")
+	assert.Equal(t, int64(1), drops.Count())
+}
+
+func TestBlockWithoutTimeout(t *testing.T) {
+	drops := metrics.NewCounter()
+	p, err := backpressure.New(backpressure.Block, 0, kind, drops, nil)
+	if err != nil {
+		assert.FailNow(t, "unable to create policy: ", err)
+	}
+	ch := make(chan int, 1)
+	q := backpressure.NewChanQueue(ch)
+
+	p.Enqueue(q, 1)
+	enqueued := make(chan bool)
+	go func() {
+		enqueued <- p.Enqueue(q, 2)
+	}()
+
+	select {
+	case <-enqueued:
+		assert.FailNow(t, "enqueued on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, 1, <-ch)
+	assert.True(t, <-enqueued)
+	assert.Equal(t, 2, <-ch)
+	assert.Equal(t, int64(0), drops.Count())
+}
+
+func TestSample(t *testing.T) {
+	p, drops := newPolicy(t, backpressure.Sample)
+	ch := make(chan int, 100)
+	q := backpressure.NewChanQueue(ch)
+
+	for i := 0; i < 1000; i++ {
+		p.Enqueue(q, i)
+	}
+	assert.True(t, len(ch) >= 50, "items are kept while the queue is less than half full")
+	assert.Equal(t, int64(1000-len(ch)), drops.Count())
+}
+
+func TestOverflow(t *testing.T) {
+	p, drops := newPolicy(t, backpressure.DropNewest)
+	var overflowed []interface{}
+	p.SetOverflow(func(item interface{}) bool {
+		overflowed = append(overflowed, item)
+		return true
+	})
+	ch := make(chan int, 1)
+	q := backpressure.NewChanQueue(ch)
+
+	p.Enqueue(q, 1)
+	assert.True(t, p.Enqueue(q, 2))
+	assert.Equal(t, []interface{}{2}, overflowed)
+	assert.Equal(t, int64(0), drops.Count())
+}
+
+func TestChanQueue(t *testing.T) {
+	ch := make(chan string, 1)
+	q := backpressure.NewChanQueue(ch)
+
+	assert.True(t, q.Offer("a"))
+	assert.False(t, q.Offer("b"))
+	assert.False(t, q.OfferTimeout("b", time.Millisecond))
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, 1, q.Cap())
+
+	item, ok := q.Poll()
+	assert.True(t, ok)
+	assert.Equal(t, "a", item)
+	_, ok = q.Poll()
+	assert.False(t, ok)
+	assert.True(t, q.OfferTimeout("c", time.Millisecond))
+	assert.Equal(t, "c", <-ch)
+}
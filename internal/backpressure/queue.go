@@ -0,0 +1,66 @@
+package backpressure
+
+import (
+	"reflect"
+	"time"
+)
+
+// ChanQueue adapts a buffered channel to Queue, whatever its element type
+type ChanQueue struct {
+	ch reflect.Value
+}
+
+// NewChanQueue wraps 'ch', it panics when 'ch' isn't a channel
+func NewChanQueue(ch interface{}) *ChanQueue {
+	v := reflect.ValueOf(ch)
+	if v.Kind() != reflect.Chan {
+		panic("backpressure: NewChanQueue of a non channel " + v.Type().String())
+	}
+	return &ChanQueue{ch: v}
+}
+
+// Offer puts the item on the channel unless it's full
+func (q *ChanQueue) Offer(item interface{}) bool {
+	return q.ch.TrySend(reflect.ValueOf(item))
+}
+
+// OfferTimeout waits up to 'timeout' for room on the channel, a timeout <= 0 waits until there is room
+func (q *ChanQueue) OfferTimeout(item interface{}, timeout time.Duration) bool {
+	if timeout <= 0 {
+		q.ch.Send(reflect.ValueOf(item))
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	chosen, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: q.ch, Send: reflect.ValueOf(item)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)},
+	})
+	return chosen == 0
+}
+
+// Poll takes the oldest item of the channel, if any
+func (q *ChanQueue) Poll() (interface{}, bool) {
+	item, ok := q.ch.TryRecv()
+	if !ok {
+		return nil, false
+	}
+	return item.Interface(), true
+}
+
+// Len returns the number of items on the channel
+func (q *ChanQueue) Len() int {
+	return q.ch.Len()
+}
+
+// Cap returns the channel capacity
+func (q *ChanQueue) Cap() int {
+	return q.ch.Cap()
+}
+
+// Used returns the number of items on the channel, for the gauges
+func (q *ChanQueue) Used() int64 {
+	return int64(q.ch.Len())
+}
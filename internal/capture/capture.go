@@ -0,0 +1,185 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// magic identifies a capture file, followed by the envelopes kind
+const magic = "CFNOZZLE-CAPTURE-1\n"
+
+// Envelope kinds
+const (
+	KindV1 = "v1"
+	KindV2 = "v2"
+)
+
+// maxRecordSize protects from corrupted record headers
+const maxRecordSize = 64 * 1024 * 1024
+
+// Writer writes gzip compressed, length-delimited records with their capture time
+type Writer struct {
+	mutex sync.Mutex
+	file  *os.File
+	gz    *gzip.Writer
+	buf   *bufio.Writer
+}
+
+// Create creates a capture file for the given envelopes kind
+func Create(path string, kind string) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(file)
+	w := &Writer{file: file, gz: gz, buf: bufio.NewWriter(gz)}
+	if _, err := w.buf.WriteString(magic + kind + "\n"); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends a record
+func (w *Writer) Write(ts time.Time, data []byte) error {
+	header := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutVarint(header, ts.UnixNano())
+	n += binary.PutUvarint(header[n:], uint64(len(data)))
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, err := w.buf.Write(header[:n]); err != nil {
+		return err
+	}
+	_, err := w.buf.Write(data)
+	return err
+}
+
+// Close flushes the pending records and closes the file
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err := w.gz.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Reader reads the records of a capture file
+type Reader struct {
+	file *os.File
+	gz   *gzip.Reader
+	buf  *bufio.Reader
+	kind string
+}
+
+// Open opens a capture file and reads its header
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("'%s' is not a capture file: %v", path, err)
+	}
+
+	r := &Reader{file: file, gz: gz, buf: bufio.NewReader(gz)}
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(r.buf, header); err != nil || string(header) != magic {
+		r.Close()
+		return nil, fmt.Errorf("'%s' is not a capture file", path)
+	}
+	kind, err := r.buf.ReadString('\n')
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("'%s' is not a capture file", path)
+	}
+	r.kind = kind[:len(kind)-1]
+	return r, nil
+}
+
+// Kind returns the kind of the captured envelopes
+func (r *Reader) Kind() string {
+	return r.kind
+}
+
+// Next returns the next record and its capture time, io.EOF at the end of the file
+func (r *Reader) Next() (time.Time, []byte, error) {
+	ts, err := binary.ReadVarint(r.buf)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	size, err := binary.ReadUvarint(r.buf)
+	if err != nil || size > maxRecordSize {
+		return time.Time{}, nil, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.buf, data); err != nil {
+		return time.Time{}, nil, io.ErrUnexpectedEOF
+	}
+	return time.Unix(0, ts), data, nil
+}
+
+// Close closes the file
+func (r *Reader) Close() error {
+	r.gz.Close()
+	return r.file.Close()
+}
+
+// Replay calls 'fn' for every record, keeping the original pace divided by 'speed'.
+// A speed of 0 or less replays as fast as possible.
+func Replay(ctx context.Context, r *Reader, speed float64, fn func(data []byte) error) (int, error) {
+	var first time.Time
+	start := time.Now()
+	count := 0
+
+	for ctx.Err() == nil {
+		ts, data, err := r.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if speed > 0 {
+			if first.IsZero() {
+				first = ts
+			}
+			wait := time.Duration(float64(ts.Sub(first))/speed) - time.Since(start)
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return count, nil
+				}
+			}
+		}
+
+		if err := fn(data); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
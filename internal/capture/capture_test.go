@@ -0,0 +1,143 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "envelopes.cap")
+
+	w, err := Create(path, KindV2)
+	assert.Nil(t, err)
+	now := time.Now()
+	assert.Nil(t, w.Write(now, []byte("first")))
+	assert.Nil(t, w.Write(now.Add(time.Second), []byte{}))
+	assert.Nil(t, w.Write(now.Add(2*time.Second), []byte("third")))
+	assert.Nil(t, w.Close())
+
+	r, err := Open(path)
+	assert.Nil(t, err)
+	defer r.Close()
+	assert.Equal(t, KindV2, r.Kind())
+
+	ts, data, err := r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, now.UnixNano(), ts.UnixNano())
+	assert.Equal(t, "first", string(data))
+
+	_, data, err = r.Next()
+	assert.Nil(t, err)
+	assert.Empty(t, data)
+
+	ts, data, err = r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(2*time.Second).UnixNano(), ts.UnixNano())
+	assert.Equal(t, "third", string(data))
+
+	_, _, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestOpenInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "invalid.cap")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("not gzip"), 0644))
+	_, err = Open(path)
+	assert.NotNil(t, err)
+
+	_, err = Open(filepath.Join(dir, "missing.cap"))
+	assert.NotNil(t, err)
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "envelopes.cap")
+
+	w, err := Create(path, KindV1)
+	assert.Nil(t, err)
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, w.Write(now.Add(time.Duration(i)*100*time.Millisecond), []byte{byte(i)}))
+	}
+	assert.Nil(t, w.Close())
+
+	// 400ms of records at 4x speed
+	r, err := Open(path)
+	assert.Nil(t, err)
+	var got []byte
+	start := time.Now()
+	count, err := Replay(context.Background(), r, 4, func(data []byte) error {
+		got = append(got, data...)
+		return nil
+	})
+	elapsed := time.Since(start)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, count)
+	assert.Equal(t, []byte{0, 1, 2, 3, 4}, got)
+	assert.True(t, elapsed >= 100*time.Millisecond, elapsed)
+	assert.True(t, elapsed < 400*time.Millisecond, elapsed)
+
+	// as fast as possible, stopping on the first error
+	r, err = Open(path)
+	assert.Nil(t, err)
+	count, err = Replay(context.Background(), r, 0, func(data []byte) error {
+		if data[0] == 2 {
+			return errors.New("invalid envelope")
+		}
+		return nil
+	})
+	r.Close()
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestRecordReplayFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "envelopes.cap")
+
+	r, err := NewRecorder(path, KindV1, func(e interface{}) ([]byte, error) {
+		if s, ok := e.(string); ok {
+			return []byte(s), nil
+		}
+		return nil, errors.New("not a string")
+	}, nil)
+	assert.Nil(t, err)
+	records, errs := r.records.Count(), r.errors.Count()
+	r.Record("first")
+	r.Record(2)
+	r.Record("third")
+	r.Close()
+	assert.Equal(t, int64(2), r.records.Count()-records)
+	assert.Equal(t, int64(1), r.errors.Count()-errs)
+
+	var got []string
+	err = ReplayFile(context.Background(), path, KindV1, 0, func(data []byte) error {
+		got = append(got, string(data))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first", "third"}, got)
+
+	err = ReplayFile(context.Background(), path, KindV2, 0, func(data []byte) error { return nil })
+	assert.EqualError(t, err, "'"+path+"' holds v1 envelopes, legacy mode is required")
+}
@@ -0,0 +1,76 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// Recorder writes the received envelopes to a capture file, 'marshal' encodes the envelopes of its kind
+type Recorder struct {
+	w       *Writer
+	marshal func(e interface{}) ([]byte, error)
+	records metrics.Counter
+	errors  metrics.Counter
+}
+
+// NewRecorder creates the capture file of the envelopes kind, the records are counted with 'internalTags'
+func NewRecorder(path string, kind string, marshal func(e interface{}) ([]byte, error), internalTags map[string]string) (*Recorder, error) {
+	w, err := Create(path, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		w:       w,
+		marshal: marshal,
+		records: utils.NewCounter("nozzle.record.envelopes", internalTags),
+		errors:  utils.NewCounter("nozzle.record.errors", internalTags),
+	}, nil
+}
+
+// Record appends an envelope, the errors are counted
+func (r *Recorder) Record(e interface{}) {
+	data, err := r.marshal(e)
+	if err == nil {
+		err = r.w.Write(time.Now(), data)
+	}
+	if err != nil {
+		r.errors.Inc(1)
+		if utils.Debug {
+			utils.Logger.Printf("[ERROR] error recording envelope: %v", err)
+		}
+		return
+	}
+	r.records.Inc(1)
+}
+
+// Close flushes and closes the capture file
+func (r *Recorder) Close() {
+	if err := r.w.Close(); err != nil {
+		utils.Logger.Printf("[ERROR] error closing the capture file: %v", err)
+	}
+}
+
+// ReplayFile calls 'fn' for every record of a capture file of the envelopes kind, see Replay
+func ReplayFile(ctx context.Context, path string, kind string, speed float64, fn func(data []byte) error) error {
+	r, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if r.Kind() != kind {
+		if kind == KindV1 {
+			return fmt.Errorf("'%s' holds %s envelopes, legacy mode must be disabled", path, r.Kind())
+		}
+		return fmt.Errorf("'%s' holds %s envelopes, legacy mode is required", path, r.Kind())
+	}
+
+	count, err := Replay(ctx, r, speed, fn)
+	utils.Logger.Printf("Replayed %d envelopes from '%s'", count, path)
+	return err
+}
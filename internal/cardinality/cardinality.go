@@ -0,0 +1,421 @@
+package cardinality
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// Overflow replaces the tag values over budget
+const Overflow = "__overflow__"
+
+// Policies applied to the points over budget
+const (
+	Collapse = "collapse"
+	Drop     = "drop"
+)
+
+// Options are the budgets configuration, a budget of 0 is unlimited
+type Options struct {
+	// MaxSeries is the number of series of a metric name, SeriesBudgets are 'pattern=budget' overrides
+	MaxSeries     int
+	SeriesBudgets []string
+	// MaxTagValues is the number of values of a tag key across all metrics, TagBudgets are 'key=budget' overrides
+	MaxTagValues int
+	TagBudgets   []string
+
+	Policy string
+	Window time.Duration
+}
+
+type seriesBudget struct {
+	pattern glob.Glob
+	budget  int
+}
+
+// Budgets are the parsed budgets, the series and tag values seen are counted again every window
+type Budgets struct {
+	Policy string
+	Window time.Duration
+
+	maxSeries    int
+	series       []seriesBudget
+	maxTagValues int
+	tagValues    map[string]int
+}
+
+// Parse validates the options, it returns nil when no budget is set
+func Parse(opts Options) (*Budgets, error) {
+	b := &Budgets{
+		Policy:       opts.Policy,
+		Window:       opts.Window,
+		maxSeries:    opts.MaxSeries,
+		maxTagValues: opts.MaxTagValues,
+		tagValues:    make(map[string]int),
+	}
+
+	enabled := opts.MaxSeries > 0 || opts.MaxTagValues > 0
+	for _, entry := range opts.SeriesBudgets {
+		pattern, budget, ok, err := parseBudget(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid series budget '%s': %v", entry, err)
+		}
+		if !ok {
+			continue
+		}
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid series budget pattern '%s': %v", pattern, err)
+		}
+		b.series = append(b.series, seriesBudget{pattern: g, budget: budget})
+		enabled = enabled || budget > 0
+	}
+	for _, entry := range opts.TagBudgets {
+		key, budget, ok, err := parseBudget(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag budget '%s': %v", entry, err)
+		}
+		if !ok {
+			continue
+		}
+		b.tagValues[key] = budget
+		enabled = enabled || budget > 0
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	switch b.Policy {
+	case Collapse, Drop:
+	default:
+		return nil, fmt.Errorf("'%s' is not a valid cardinality policy (%s or %s)", b.Policy, Collapse, Drop)
+	}
+	if b.Window <= 0 {
+		return nil, fmt.Errorf("the cardinality window must be positive")
+	}
+	return b, nil
+}
+
+// parseBudget parses a 'name=budget' entry, ok is false for empty entries
+func parseBudget(entry string) (string, int, bool, error) {
+	if entry = strings.TrimSpace(entry); len(entry) == 0 {
+		return "", 0, false, nil
+	}
+	name, value, err := utils.SplitPair(entry, "name=budget")
+	if err != nil {
+		return "", 0, false, err
+	}
+	budget, err := strconv.Atoi(value)
+	if err != nil || budget < 0 {
+		return "", 0, false, fmt.Errorf("the budget must be a positive number")
+	}
+	return name, budget, true, nil
+}
+
+// seriesBudget returns the budget of the first pattern matching the metric name
+func (b *Budgets) seriesBudget(name string) int {
+	for _, s := range b.series {
+		if s.pattern.Match(name) {
+			return s.budget
+		}
+	}
+	return b.maxSeries
+}
+
+func (b *Budgets) tagBudget(key string) int {
+	if budget, ok := b.tagValues[key]; ok {
+		return budget
+	}
+	return b.maxTagValues
+}
+
+// shards of the limiter state, the series are sharded by metric name and the tag values by tag key
+const shards = 32
+
+type shard struct {
+	mutex     sync.Mutex
+	metrics   map[string]*metricSeries
+	tagValues map[string]map[string]struct{}
+}
+
+// metricSeries are the series of a metric, and the tag values they share
+type metricSeries struct {
+	series  map[uint64]struct{}
+	values  map[string]string
+	varying map[string]bool
+}
+
+// add keeps a new series, and the tag keys with several values
+func (ms *metricSeries) add(key uint64, tags map[string]string, collapsed []string) {
+	ms.series[key] = struct{}{}
+	for k, v := range tags {
+		if contains(collapsed, k) {
+			v = Overflow
+		}
+		if value, ok := ms.values[k]; !ok {
+			ms.values[k] = v
+		} else if value != v {
+			ms.varying[k] = true
+		}
+	}
+	for k := range ms.values {
+		if _, ok := tags[k]; !ok {
+			ms.varying[k] = true
+		}
+	}
+}
+
+// constant returns true if all the series of the metric have the tag value
+func (ms *metricSeries) constant(k, v string) bool {
+	value, ok := ms.values[k]
+	return ok && value == v && !ms.varying[k]
+}
+
+// Limiter tracks the series of every metric name and the values of every tag key, and collapses or drops
+// the points of the new series over budget. It's safe for concurrent use.
+type Limiter struct {
+	budgets *Budgets
+	shards  [shards]shard
+
+	tripMutex sync.Mutex
+	tripped   map[string]bool
+	overflows map[string]metrics.Counter
+
+	tags      map[string]string
+	collapsed metrics.Counter
+	dropped   metrics.Counter
+
+	done chan struct{}
+}
+
+// NewLimiter creates a Limiter, its internal metrics are reported with 'tags'
+func NewLimiter(budgets *Budgets, tags map[string]string) *Limiter {
+	l := &Limiter{
+		budgets:   budgets,
+		tripped:   make(map[string]bool),
+		overflows: make(map[string]metrics.Counter),
+		tags:      tags,
+		collapsed: utils.NewCounter("nozzle.cardinality.collapsed", tags),
+		dropped:   utils.NewCounter("nozzle.cardinality.dropped", tags),
+		done:      make(chan struct{}),
+	}
+	for i := range l.shards {
+		l.shards[i].metrics = make(map[string]*metricSeries)
+		l.shards[i].tagValues = make(map[string]map[string]struct{})
+	}
+	return l
+}
+
+// Start counts the series and tag values again every window
+func (l *Limiter) Start() {
+	ticker := time.NewTicker(l.budgets.Window)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.reset()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the window resets
+func (l *Limiter) Close() {
+	close(l.done)
+}
+
+func (l *Limiter) reset() {
+	for i := range l.shards {
+		sh := &l.shards[i]
+		sh.mutex.Lock()
+		sh.metrics = make(map[string]*metricSeries, len(sh.metrics))
+		sh.tagValues = make(map[string]map[string]struct{}, len(sh.tagValues))
+		sh.mutex.Unlock()
+	}
+
+	l.tripMutex.Lock()
+	l.tripped = make(map[string]bool)
+	l.tripMutex.Unlock()
+}
+
+func (l *Limiter) shard(key string) *shard {
+	return &l.shards[hashString(offset64, key)%shards]
+}
+
+// Limit returns the tags to send the point with, and false when the point is dropped. The tags over
+// budget are collapsed in a copy, the tags map of the caller is never changed.
+func (l *Limiter) Limit(name, source string, tags map[string]string) (map[string]string, bool) {
+	var collapsed []string
+	for k, v := range tags {
+		budget := l.budgets.tagBudget(k)
+		if budget <= 0 {
+			continue
+		}
+		if !l.addTagValue(k, v, budget) {
+			l.trip("tag_key", k, budget)
+			collapsed = append(collapsed, k)
+		}
+	}
+
+	if len(collapsed) > 0 && l.budgets.Policy == Drop {
+		l.dropped.Inc(1)
+		return nil, false
+	}
+
+	if budget := l.budgets.seriesBudget(name); budget > 0 {
+		var ok bool
+		if collapsed, ok = l.addSeries(name, source, tags, collapsed, budget); !ok {
+			l.trip("metric", name, budget)
+			if l.budgets.Policy == Drop {
+				l.dropped.Inc(1)
+				return nil, false
+			}
+		}
+	}
+
+	if len(collapsed) == 0 {
+		return tags, true
+	}
+
+	l.collapsed.Inc(1)
+	newTags := utils.CopyTags(tags)
+	for _, k := range collapsed {
+		newTags[k] = Overflow
+	}
+	return newTags, true
+}
+
+// addTagValue returns false when the value is new and the tag key is over budget
+func (l *Limiter) addTagValue(k, v string, budget int) bool {
+	sh := l.shard(k)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	values, ok := sh.tagValues[k]
+	if !ok {
+		values = make(map[string]struct{})
+		sh.tagValues[k] = values
+	}
+	if _, ok := values[v]; ok {
+		return true
+	}
+	if len(values) < budget {
+		values[v] = struct{}{}
+		return true
+	}
+	return false
+}
+
+// addSeries returns false when the series is new and the metric is over budget, with the tags to collapse:
+// all the new series of the metric end up in an overflow series keeping the tags with the same value on
+// every series, like the deployment or the foundation
+func (l *Limiter) addSeries(name, source string, tags map[string]string, collapsed []string, budget int) ([]string, bool) {
+	sh := l.shard(name)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	ms, ok := sh.metrics[name]
+	if !ok {
+		ms = &metricSeries{
+			series:  make(map[uint64]struct{}),
+			values:  make(map[string]string),
+			varying: make(map[string]bool),
+		}
+		sh.metrics[name] = ms
+	}
+
+	key := seriesHash(source, tags, collapsed)
+	if _, ok := ms.series[key]; ok {
+		return collapsed, true
+	}
+	if len(ms.series) < budget {
+		ms.add(key, tags, collapsed)
+		return collapsed, true
+	}
+
+	for k, v := range tags {
+		if !ms.constant(k, v) && !contains(collapsed, k) {
+			collapsed = append(collapsed, k)
+		}
+	}
+	return collapsed, false
+}
+
+// trip counts the points over the budget of a metric or a tag key, and logs it once per window
+func (l *Limiter) trip(kind, name string, budget int) {
+	culprit := kind + ":" + name
+	l.tripMutex.Lock()
+	defer l.tripMutex.Unlock()
+
+	counter, ok := l.overflows[culprit]
+	if !ok {
+		tags := utils.CopyTags(l.tags)
+		tags[kind] = name
+		counter = utils.NewCounter("nozzle.cardinality.overflow", tags)
+		l.overflows[culprit] = counter
+	}
+	counter.Inc(1)
+
+	if !l.tripped[culprit] {
+		l.tripped[culprit] = true
+		utils.Logger.Printf("[ERROR] %s '%s' is over its budget of %d %s, %s", strings.Replace(kind, "_", " ", 1), name, budget, unit(kind), l.action(unit(kind)))
+	}
+}
+
+func unit(kind string) string {
+	if kind == "metric" {
+		return "series"
+	}
+	return "values"
+}
+
+func (l *Limiter) action(unit string) string {
+	if l.budgets.Policy == Drop {
+		return "the points with new " + unit + " are dropped"
+	}
+	return "the new " + unit + " are collapsed to '" + Overflow + "'"
+}
+
+// seriesHash identifies a series of a metric, it doesn't depend on the tags order so it doesn't need to sort them
+func seriesHash(source string, tags map[string]string, collapsed []string) uint64 {
+	h := hashString(offset64, source)
+	for k, v := range tags {
+		if contains(collapsed, k) {
+			v = Overflow
+		}
+		h += hashString(hashString(offset64, k)^0xff, v)
+	}
+	return h
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// FNV-1a
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+func hashString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
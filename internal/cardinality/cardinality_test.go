@@ -0,0 +1,137 @@
+package cardinality_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/cardinality"
+)
+
+func TestParse(t *testing.T) {
+	budgets, err := cardinality.Parse(cardinality.Options{Policy: cardinality.Collapse, Window: time.Hour})
+	assert.Nil(t, err)
+	assert.Nil(t, budgets, "no budget")
+
+	budgets, err = cardinality.Parse(cardinality.Options{SeriesBudgets: []string{"pcf.gorouter.*=100", " "}, Policy: cardinality.Drop, Window: time.Hour})
+	assert.Nil(t, err)
+	assert.NotNil(t, budgets)
+
+	for _, opts := range []cardinality.Options{
+		{MaxSeries: 10, Policy: "sample", Window: time.Hour},
+		{MaxSeries: 10, Policy: cardinality.Drop},
+		{SeriesBudgets: []string{"pcf.*"}, Policy: cardinality.Drop, Window: time.Hour},
+		{SeriesBudgets: []string{"pcf.*=-1"}, Policy: cardinality.Drop, Window: time.Hour},
+		{SeriesBudgets: []string{"pcf.[=10"}, Policy: cardinality.Drop, Window: time.Hour},
+		{TagBudgets: []string{"request_id=many"}, Policy: cardinality.Drop, Window: time.Hour},
+	} {
+		_, err := cardinality.Parse(opts)
+		assert.NotNil(t, err, fmt.Sprint(opts))
+	}
+}
+
+func TestSeriesBudget(t *testing.T) {
+	budgets, err := cardinality.Parse(cardinality.Options{
+		MaxSeries:     2,
+		SeriesBudgets: []string{"pcf.unlimited.*=0"},
+		Policy:        cardinality.Collapse,
+		Window:        time.Hour,
+	})
+	assert.Nil(t, err)
+	limiter := cardinality.NewLimiter(budgets, nil)
+
+	for i := 0; i < 2; i++ {
+		tags := map[string]string{"app": "foo", "instance": fmt.Sprint(i)}
+		limited, ok := limiter.Limit("pcf.app.requests", "source", tags)
+		assert.True(t, ok)
+		assert.Equal(t, tags, limited)
+	}
+
+	// the tags with the same value on every series are kept
+	tags := map[string]string{"app": "foo", "instance": "2"}
+	limited, ok := limiter.Limit("pcf.app.requests", "source", tags)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"app": "foo", "instance": cardinality.Overflow}, limited)
+	assert.Equal(t, "2", tags["instance"], "the caller tags are unchanged")
+
+	limited, ok = limiter.Limit("pcf.app.requests", "source", map[string]string{"app": "bar", "instance": "3", "extra": "x"})
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"app": cardinality.Overflow, "instance": cardinality.Overflow, "extra": cardinality.Overflow}, limited)
+
+	// known series and metrics without budget are kept
+	limited, ok = limiter.Limit("pcf.app.requests", "source", map[string]string{"instance": "1", "app": "foo"})
+	assert.True(t, ok)
+	assert.Equal(t, "1", limited["instance"])
+	for i := 0; i < 10; i++ {
+		limited, ok = limiter.Limit("pcf.unlimited.requests", "source", map[string]string{"instance": fmt.Sprint(i)})
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprint(i), limited["instance"])
+	}
+}
+
+func TestTagBudget(t *testing.T) {
+	budgets, err := cardinality.Parse(cardinality.Options{
+		TagBudgets: []string{"request_id=2"},
+		Policy:     cardinality.Collapse,
+		Window:     time.Hour,
+	})
+	assert.Nil(t, err)
+	limiter := cardinality.NewLimiter(budgets, nil)
+
+	for _, id := range []string{"a", "b", "a"} {
+		limited, ok := limiter.Limit(fmt.Sprint("pcf.metric.", id), "source", map[string]string{"request_id": id})
+		assert.True(t, ok)
+		assert.Equal(t, id, limited["request_id"])
+	}
+
+	limited, ok := limiter.Limit("pcf.other", "source", map[string]string{"request_id": "c", "app": "foo"})
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"request_id": cardinality.Overflow, "app": "foo"}, limited)
+
+	budgets.Policy = cardinality.Drop
+	_, ok = limiter.Limit("pcf.other", "source", map[string]string{"request_id": "d"})
+	assert.False(t, ok)
+	_, ok = limiter.Limit("pcf.other", "source", map[string]string{"request_id": "b"})
+	assert.True(t, ok)
+}
+
+func TestWindow(t *testing.T) {
+	budgets, err := cardinality.Parse(cardinality.Options{MaxSeries: 1, Policy: cardinality.Drop, Window: 20 * time.Millisecond})
+	assert.Nil(t, err)
+	limiter := cardinality.NewLimiter(budgets, nil)
+	limiter.Start()
+	defer limiter.Close()
+
+	_, ok := limiter.Limit("pcf.metric", "source-1", nil)
+	assert.True(t, ok)
+	_, ok = limiter.Limit("pcf.metric", "source-2", nil)
+	assert.False(t, ok)
+
+	assert.Eventually(t, func() bool {
+		_, ok := limiter.Limit("pcf.metric", "source-2", nil)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConcurrentLimit(t *testing.T) {
+	budgets, err := cardinality.Parse(cardinality.Options{MaxSeries: 10, MaxTagValues: 50, Policy: cardinality.Collapse, Window: time.Hour})
+	assert.Nil(t, err)
+	limiter := cardinality.NewLimiter(budgets, nil)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				tags := map[string]string{"foundation": "foo", "instance": fmt.Sprint(i)}
+				limited, ok := limiter.Limit(fmt.Sprint("pcf.metric.", w), "source", tags)
+				assert.True(t, ok)
+				assert.Equal(t, "foo", limited["foundation"])
+			}
+		}(w)
+	}
+	wg.Wait()
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -8,7 +9,13 @@ import (
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/aggregation"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/cardinality"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/derived"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/filter"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/logrules"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/naming"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/tlsconfig"
 )
 
 // Config holds users provided env variables
@@ -19,22 +26,92 @@ type Config struct {
 
 // NozzleConfig holds specific PCF env variables
 type NozzleConfig struct {
-	APIURL       string `required:"true" envconfig:"api_url"`
-	Username     string `required:"true"`
-	Password     string `required:"true"`
-	LogStreamURL string `required:"true" envconfig:"log_stream_url"`
+	APIURL       string `envconfig:"api_url"`
+	Username     string
+	Password     string
+	LogStreamURL string `envconfig:"log_stream_url"`
 
-	FirehoseSubscriptionID string `required:"true" envconfig:"firehose_subscription_id"`
+	Foundations     Foundations `envconfig:"foundations"`
+	FoundationsFile string      `split_words:"true"`
+
+	RLPTransport  string `envconfig:"rlp_transport" default:"gateway"`
+	RLPAddr       string `envconfig:"rlp_addr"`
+	RLPCACertFile string `envconfig:"rlp_ca_cert_file"`
+	RLPCertFile   string `envconfig:"rlp_cert_file"`
+	RLPKeyFile    string `envconfig:"rlp_key_file"`
+
+	// SyslogAddr defaults to an unprivileged port, the nozzle doesn't run as root
+	SyslogAddr     string `split_words:"true" default:":6514"`
+	SyslogCertFile string `split_words:"true"`
+	SyslogKeyFile  string `split_words:"true"`
+
+	FirehoseSubscriptionID string `envconfig:"firehose_subscription_id"`
 	SkipSSL                bool   `default:"false" envconfig:"skip_ssl"`
 
+	CACertFile     string `split_words:"true"`
+	CACert         string `split_words:"true"`
+	ClientCertFile string `split_words:"true"`
+	ClientKeyFile  string `split_words:"true"`
+	TLSMinVersion  string `envconfig:"tls_min_version" default:"1.2"`
+
+	TLS *tls.Config `ignored:"true"`
+
 	EnableAppCache     bool          `default:"true" envconfig:"enable_app_cache"`
 	AppCacheExpiration time.Duration `split_words:"true" default:"6h"`
 	AppCacheSize       int           `split_words:"true" default:"50000"`
 
 	SelectedEvents string `required:"false" envconfig:"selected_events"`
 
+	SourceIDs []string `envconfig:"source_ids"`
+	AppNames  []string `split_words:"true"`
+
+	DeltaCounters         bool          `split_words:"true" default:"false"`
+	CounterModes          []string      `split_words:"true"`
+	CounterRates          []string      `split_words:"true"`
+	CounterRateExpiration time.Duration `split_words:"true" default:"10m"`
+
+	EnableAppRollups   bool          `split_words:"true" default:"false"`
+	AppRollupsInterval time.Duration `split_words:"true" default:"1m"`
+
+	EnableTimers bool `split_words:"true" default:"false"`
+	EnableEvents bool `split_words:"true" default:"false"`
+	EnableLogs   bool `split_words:"true" default:"false"`
+
+	LogMetricsInterval time.Duration `split_words:"true" default:"1m"`
+	LogRulesFile       string        `split_words:"true"`
+
+	LogRules logrules.Rules `ignored:"true"`
+
+	NamingRulesFile string `split_words:"true"`
+
+	NamingRules *naming.Rules `ignored:"true"`
+
+	EnableDerivedMetrics bool   `split_words:"true" default:"false"`
+	DerivedMetricsFile   string `split_words:"true"`
+
+	DerivedMetrics derived.Formulas `ignored:"true"`
+
 	AdvancedConfig advancedConfig `envconfig:"ADVANCED_CONFIG"`
 
+	ReconnectMinBackoff time.Duration `split_words:"true" default:"1s"`
+	ReconnectMaxBackoff time.Duration `split_words:"true" default:"2m"`
+	ReconnectMaxRetries int           `split_words:"true" default:"0"`
+	StreamStallTimeout  time.Duration `split_words:"true" default:"5m"`
+
+	ShutdownTimeout time.Duration `split_words:"true" default:"5s"`
+
+	SpillDir   string `split_words:"true"`
+	SpillMaxMb int    `split_words:"true" default:"512"`
+
+	RecordFile  string  `split_words:"true"`
+	ReplayFile  string  `split_words:"true"`
+	ReplaySpeed float64 `split_words:"true" default:"1"`
+
+	// QueuePolicy defaults to block without timeout in legacy mode, as it always blocked on a full queue, and to drop-newest in v2 mode,
+	// a QueueBlockTimeout <= 0 blocks until there is room
+	QueuePolicy       string        `split_words:"true"`
+	QueueBlockTimeout time.Duration `split_words:"true" default:"1s"`
+
 	ChannelSize int `split_words:"true" default:"10000"`
 	Workers     int `split_words:"true" default:"2"`
 }
@@ -49,10 +126,24 @@ type WavefrontConfig struct {
 	MaxBufferSize     int    `default:"100000" envconfig:"MAX_BUFFER_SIZE"`
 	BatchSize         int    `default:"10000" envconfig:"BATCH_SIZE"`
 	Prefix            string `required:"true" envconfig:"PREFIX"`
-	Foundation        string `required:"true" envconfig:"FOUNDATION"`
+	Foundation        string `envconfig:"FOUNDATION"`
 	ProxyHisToMinPort int    `default:"40001" envconfig:"PROXY_HISTOGRAM_MINUTE_PORT"`
+	DryRun            bool   `default:"false" envconfig:"DRY_RUN"`
+
+	AggregationRules []string `envconfig:"AGGREGATIONS"`
 
-	Filters *filter.Filters `ignored:"true"`
+	CardinalityMaxSeries     int           `default:"0" envconfig:"CARDINALITY_MAX_SERIES"`
+	CardinalitySeriesBudgets []string      `envconfig:"CARDINALITY_SERIES_BUDGETS"`
+	CardinalityMaxTagValues  int           `default:"0" envconfig:"CARDINALITY_MAX_TAG_VALUES"`
+	CardinalityTagBudgets    []string      `envconfig:"CARDINALITY_TAG_BUDGETS"`
+	CardinalityPolicy        string        `default:"collapse" envconfig:"CARDINALITY_POLICY"`
+	CardinalityWindow        time.Duration `default:"1h" envconfig:"CARDINALITY_WINDOW"`
+
+	Aggregations aggregation.Rules    `ignored:"true"`
+	Cardinality  *cardinality.Budgets `ignored:"true"`
+	Filters      *filter.Filters      `ignored:"true"`
+	// TLS isn't applied, the SDK senders have no TLS options, so the direct connection rejects a CA bundle or a client certificate
+	TLS *tls.Config `ignored:"true"`
 }
 
 type advancedConfig struct {
@@ -103,7 +194,54 @@ func ParseConfig() (*Config, error) {
 		return nil, err
 	}
 
+	nozzleConfig.TLS, err = tlsconfig.New(tlsconfig.Options{
+		CACertFile:     nozzleConfig.CACertFile,
+		CACert:         nozzleConfig.CACert,
+		ClientCertFile: nozzleConfig.ClientCertFile,
+		ClientKeyFile:  nozzleConfig.ClientKeyFile,
+		MinVersion:     nozzleConfig.TLSMinVersion,
+		SkipVerify:     nozzleConfig.SkipSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nozzleConfig.FoundationsFile) > 0 {
+		nozzleConfig.Foundations, err = loadFoundations(nozzleConfig.FoundationsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(nozzleConfig.LogRulesFile) > 0 {
+		nozzleConfig.LogRules, err = logrules.Load(nozzleConfig.LogRulesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(nozzleConfig.NamingRulesFile) > 0 {
+		nozzleConfig.NamingRules, err = naming.Load(nozzleConfig.NamingRulesFile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		nozzleConfig.NamingRules = naming.Default()
+	}
+
+	if nozzleConfig.EnableDerivedMetrics {
+		if len(nozzleConfig.DerivedMetricsFile) > 0 {
+			nozzleConfig.DerivedMetrics, err = derived.Load(nozzleConfig.DerivedMetricsFile)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			nozzleConfig.DerivedMetrics = derived.Default()
+		}
+	}
+
 	if len(nozzleConfig.AdvancedConfig.Values.SelectedEvents) > 0 {
+		nozzleConfig.SelectedEvents = strings.Join(nozzleConfig.AdvancedConfig.Values.SelectedEvents, ",")
 		os.Setenv("NOZZLE_SELECTED_EVENTS", strings.Join(nozzleConfig.AdvancedConfig.Values.SelectedEvents, ","))
 	}
 
@@ -112,6 +250,24 @@ func ParseConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	wavefrontConfig.TLS = nozzleConfig.TLS
+
+	wavefrontConfig.Aggregations, err = aggregation.Parse(wavefrontConfig.AggregationRules)
+	if err != nil {
+		return nil, err
+	}
+
+	wavefrontConfig.Cardinality, err = cardinality.Parse(cardinality.Options{
+		MaxSeries:     wavefrontConfig.CardinalityMaxSeries,
+		SeriesBudgets: wavefrontConfig.CardinalitySeriesBudgets,
+		MaxTagValues:  wavefrontConfig.CardinalityMaxTagValues,
+		TagBudgets:    wavefrontConfig.CardinalityTagBudgets,
+		Policy:        wavefrontConfig.CardinalityPolicy,
+		Window:        wavefrontConfig.CardinalityWindow,
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	if nozzleConfig.AdvancedConfig.haveCustomProxy() {
 		wavefrontConfig.ProxyAddr = nozzleConfig.AdvancedConfig.Values.ProxyAddress
@@ -147,6 +303,9 @@ func ParseConfig() (*Config, error) {
 	// if len(nozzleConfig.AdvancedConfig.Values.)
 
 	config := &Config{Nozzle: nozzleConfig, Wavefront: wavefrontConfig}
+	if err := config.validateFoundations(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
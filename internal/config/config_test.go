@@ -4,9 +4,11 @@ import (
 	"log"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/testutil"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/legacy"
 )
 
@@ -121,6 +123,21 @@ func TestSelectedEventsLegacy(t *testing.T) {
 	assert.Equal(t, 2, len(selectedEvents), selectedEvents)
 
 	assertPanic(t, func() { legacy.ParseSelectedEvents("[ValueMetric Contai__nerMetric]") })
+
+	selectedEvents = legacy.ParseSelectedEvents("Gauge,Counter")
+	assert.Equal(t, 3, len(selectedEvents), selectedEvents)
+}
+
+func TestAdvancedConfigSelectedEvents(t *testing.T) {
+	os.Clearenv()
+	setUpFooEnv()
+	os.Setenv("ADVANCED_CONFIG", `{"value":"yes","selected_option":{"selected_events":["Gauge","Timer"]}}`)
+
+	cfg, err := config.ParseConfig()
+	if err != nil {
+		assert.FailNow(t, "[ERROR] Unable to build config from environment: ", err)
+	}
+	assert.Equal(t, "Gauge,Timer", cfg.Nozzle.SelectedEvents)
 }
 
 func assertPanic(t *testing.T, f func()) {
@@ -187,3 +204,130 @@ func contains(a []string, x string) bool {
 	}
 	return false
 }
+
+func TestFoundations(t *testing.T) {
+	os.Clearenv()
+	setUpFooEnv()
+	os.Setenv("NOZZLE_SPILL_DIR", "/var/spill")
+	os.Setenv("NOZZLE_FOUNDATIONS", `[
+		{"foundation": "east", "api_url": "api.east", "log_stream_url": "https://log-stream.east", "firehose_subscription_id": "east-nozzle"},
+		{"foundation": "west", "api_url": "api.west", "username": "west-user", "password": "west-pass"}
+	]`)
+
+	cfg, err := config.ParseConfig()
+	assert.Nil(t, err)
+
+	confs := cfg.PerFoundation()
+	assert.Len(t, confs, 2)
+
+	east, west := confs[0], confs[1]
+	assert.Equal(t, "east", east.Wavefront.Foundation)
+	assert.Equal(t, "api.east", east.Nozzle.APIURL)
+	assert.Equal(t, "foo", east.Nozzle.Username)
+	assert.Equal(t, "https://log-stream.east", east.Nozzle.LogStreamURL)
+	assert.Equal(t, "east-nozzle", east.Nozzle.FirehoseSubscriptionID)
+	assert.Equal(t, "/var/spill/east", east.Nozzle.SpillDir)
+	assert.Equal(t, "east", east.InternalTags()["foundation"])
+	assert.Equal(t, "east-nozzle", east.InternalTags()["firehose-subscription-id"])
+
+	assert.Equal(t, "west", west.Wavefront.Foundation)
+	assert.Equal(t, "west-user", west.Nozzle.Username)
+	assert.Equal(t, "west-pass", west.Nozzle.Password)
+	assert.Equal(t, "true", west.Nozzle.LogStreamURL)
+	assert.Equal(t, "foo", west.Nozzle.FirehoseSubscriptionID)
+	assert.Equal(t, "/var/spill/west", west.Nozzle.SpillDir)
+
+	// the shared settings are untouched
+	assert.Equal(t, "foo", cfg.Wavefront.Foundation)
+	assert.Equal(t, "/var/spill", cfg.Nozzle.SpillDir)
+	assert.Same(t, cfg.Wavefront.Filters, west.Wavefront.Filters)
+}
+
+func TestFoundationsValidation(t *testing.T) {
+	os.Clearenv()
+	setUpFooEnv()
+	os.Setenv("NOZZLE_FOUNDATIONS", `[{"foundation": "east"}, {"foundation": "east"}]`)
+	_, err := config.ParseConfig()
+	assert.NotNil(t, err)
+
+	os.Setenv("NOZZLE_FOUNDATIONS", `[{"foundation": "east"}, {"foundation": "west"}]`)
+	os.Setenv("NOZZLE_RLP_TRANSPORT", "syslog")
+	_, err = config.ParseConfig()
+	assert.NotNil(t, err)
+
+	os.Clearenv()
+	os.Setenv("WAVEFRONT_PREFIX", "foo")
+	os.Setenv("NOZZLE_USERNAME", "foo")
+	os.Setenv("NOZZLE_PASSWORD", "foo")
+	os.Setenv("NOZZLE_FOUNDATIONS", `[{"foundation": "east", "api_url": "api.east", "firehose_subscription_id": "east-nozzle"}, {"foundation": "west"}]`)
+	_, err = config.ParseConfig()
+	assert.EqualError(t, err, "foundation 'west': required key NOZZLE_API_URL, NOZZLE_FIREHOSE_SUBSCRIPTION_ID missing value")
+}
+
+func TestFoundationsFile(t *testing.T) {
+	os.Clearenv()
+	setUpFooEnv()
+
+	path := testutil.WriteFile(t, "foundations", `[{"foundation": "east"}, {"foundation": "west"}, {"foundation": "north"}]`)
+	defer os.Remove(path)
+
+	os.Setenv("NOZZLE_FOUNDATIONS_FILE", path)
+	cfg, err := config.ParseConfig()
+	assert.Nil(t, err)
+	assert.Len(t, cfg.PerFoundation(), 3)
+
+	os.Setenv("NOZZLE_FOUNDATIONS_FILE", path+".missing")
+	_, err = config.ParseConfig()
+	assert.NotNil(t, err)
+}
+
+func TestAggregations(t *testing.T) {
+	os.Clearenv()
+	setUpFooEnv()
+	os.Setenv("WAVEFRONT_AGGREGATIONS", "pcf.container.*=1m:min+max,pcf.gorouter.*=30s")
+	cfg, err := config.ParseConfig()
+	assert.Nil(t, err)
+	assert.Len(t, cfg.Wavefront.Aggregations, 2)
+	assert.NotNil(t, cfg.Wavefront.Aggregations.Match("pcf.container.rep.cpu_percentage"))
+
+	os.Setenv("WAVEFRONT_AGGREGATIONS", "pcf.container.*=1m:median")
+	_, err = config.ParseConfig()
+	assert.NotNil(t, err)
+}
+
+func TestDerivedMetrics(t *testing.T) {
+	os.Clearenv()
+	setUpFooEnv()
+	cfg, err := config.ParseConfig()
+	assert.Nil(t, err)
+	assert.Empty(t, cfg.Nozzle.DerivedMetrics, "the derived metrics are opt-in")
+
+	os.Setenv("NOZZLE_ENABLE_DERIVED_METRICS", "true")
+	cfg, err = config.ParseConfig()
+	assert.Nil(t, err)
+	assert.Len(t, cfg.Nozzle.DerivedMetrics, 3)
+
+	os.Setenv("NOZZLE_ENABLE_DERIVED_METRICS", "true")
+	os.Setenv("NOZZLE_DERIVED_METRICS_FILE", "/missing/derived-metrics.json")
+	_, err = config.ParseConfig()
+	assert.NotNil(t, err)
+}
+
+func TestCardinality(t *testing.T) {
+	os.Clearenv()
+	setUpFooEnv()
+	cfg, err := config.ParseConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, cfg.Wavefront.Cardinality)
+
+	os.Setenv("WAVEFRONT_CARDINALITY_MAX_SERIES", "1000")
+	os.Setenv("WAVEFRONT_CARDINALITY_TAG_BUDGETS", "request_id=100,instance_id=0")
+	cfg, err = config.ParseConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "collapse", cfg.Wavefront.Cardinality.Policy)
+	assert.Equal(t, time.Hour, cfg.Wavefront.Cardinality.Window)
+
+	os.Setenv("WAVEFRONT_CARDINALITY_POLICY", "sample")
+	_, err = config.ParseConfig()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// Foundation holds the connection settings of a foundation, empty values are taken from the NOZZLE_* variables
+type Foundation struct {
+	Foundation             string `json:"foundation"`
+	APIURL                 string `json:"api_url"`
+	Username               string `json:"username"`
+	Password               string `json:"password"`
+	LogStreamURL           string `json:"log_stream_url"`
+	FirehoseSubscriptionID string `json:"firehose_subscription_id"`
+}
+
+// Foundations list of foundations consumed by a single nozzle
+type Foundations []*Foundation
+
+// Decode json
+func (f *Foundations) Decode(value string) error {
+	return json.Unmarshal([]byte(value), f)
+}
+
+func loadFoundations(path string) (Foundations, error) {
+	var foundations Foundations
+	if err := utils.LoadJSON(path, "foundations", &foundations); err != nil {
+		return nil, err
+	}
+	return foundations, nil
+}
+
+// PerFoundation returns a Config for each foundation, or the Config itself when there is a single one
+func (c *Config) PerFoundation() []*Config {
+	if len(c.Nozzle.Foundations) == 0 {
+		return []*Config{c}
+	}
+
+	var confs []*Config
+	for _, f := range c.Nozzle.Foundations {
+		nozzleConfig := *c.Nozzle
+		wavefrontConfig := *c.Wavefront
+		nozzleConfig.Foundations = nil
+
+		override(&wavefrontConfig.Foundation, f.Foundation)
+		override(&nozzleConfig.APIURL, f.APIURL)
+		override(&nozzleConfig.Username, f.Username)
+		override(&nozzleConfig.Password, f.Password)
+		override(&nozzleConfig.LogStreamURL, f.LogStreamURL)
+		override(&nozzleConfig.FirehoseSubscriptionID, f.FirehoseSubscriptionID)
+
+		// files and directories can't be shared
+		if len(nozzleConfig.SpillDir) > 0 {
+			nozzleConfig.SpillDir = filepath.Join(nozzleConfig.SpillDir, f.Foundation)
+		}
+		if len(nozzleConfig.RecordFile) > 0 {
+			nozzleConfig.RecordFile += "." + f.Foundation
+		}
+
+		confs = append(confs, &Config{Nozzle: &nozzleConfig, Wavefront: &wavefrontConfig})
+	}
+	return confs
+}
+
+// InternalTags returns the tags for the internal metrics of the foundation
+func (c *Config) InternalTags() map[string]string {
+	tags := utils.GetInternalTags()
+	tags["foundation"] = c.Wavefront.Foundation
+	tags["firehose-subscription-id"] = c.Nozzle.FirehoseSubscriptionID
+	return tags
+}
+
+// validateFoundations checks every foundation, and the settings that can't be used with several of them
+func (c *Config) validateFoundations() error {
+	confs := c.PerFoundation()
+	names := make(map[string]bool)
+	for _, conf := range confs {
+		if err := conf.validate(); err != nil {
+			return err
+		}
+		if names[conf.Wavefront.Foundation] {
+			return fmt.Errorf("foundation '%s' is defined more than once", conf.Wavefront.Foundation)
+		}
+		names[conf.Wavefront.Foundation] = true
+	}
+
+	if len(confs) > 1 {
+		switch {
+		case c.Nozzle.AdvancedConfig.Values.LegacyMode:
+			return fmt.Errorf("legacy mode supports a single foundation")
+		case c.Nozzle.RLPTransport == "syslog":
+			return fmt.Errorf("the syslog transport supports a single foundation")
+		case len(c.Nozzle.ReplayFile) > 0:
+			return fmt.Errorf("NOZZLE_REPLAY_FILE supports a single foundation")
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	var missing []string
+	check := func(name, value string) {
+		if len(value) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	check("NOZZLE_API_URL", c.Nozzle.APIURL)
+	check("NOZZLE_USERNAME", c.Nozzle.Username)
+	check("NOZZLE_PASSWORD", c.Nozzle.Password)
+	check("NOZZLE_FIREHOSE_SUBSCRIPTION_ID", c.Nozzle.FirehoseSubscriptionID)
+	check("WAVEFRONT_FOUNDATION", c.Wavefront.Foundation)
+
+	if len(missing) > 0 {
+		if len(c.Wavefront.Foundation) > 0 {
+			return fmt.Errorf("foundation '%s': required key %s missing value", c.Wavefront.Foundation, strings.Join(missing, ", "))
+		}
+		return fmt.Errorf("required key %s missing value", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func override(value *string, foundationValue string) {
+	if len(foundationValue) > 0 {
+		*value = foundationValue
+	}
+}
@@ -0,0 +1,279 @@
+package derived
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/gobwas/glob"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// defaultFormulas are the container utilization ratios, they are applied after the file formulas
+var defaultFormulas = []*Formula{
+	{Name: "memory_utilization", Origin: "rep", Unit: "percentage", Expression: "100 * memory / memory_quota"},
+	{Name: "disk_utilization", Origin: "rep", Unit: "percentage", Expression: "100 * disk / disk_quota"},
+	{Name: "cpu_entitlement", Origin: "rep", Unit: "percentage", Expression: "100 * absolute_usage / absolute_entitlement"},
+}
+
+// Formula computes a gauge from the values of a gauge envelope, it applies to the envelopes of the
+// matching origin (a glob, any origin when empty) holding all the fields of the expression
+type Formula struct {
+	Name       string `json:"name"`
+	Origin     string `json:"origin"`
+	Unit       string `json:"unit"`
+	Expression string `json:"expression"`
+	Disabled   bool   `json:"disabled"`
+
+	origin glob.Glob
+	expr   *node
+	fields []string
+}
+
+// Formulas list of derived metrics formulas
+type Formulas []*Formula
+
+// Default returns the built-in formulas
+func Default() Formulas {
+	formulas, err := compile(nil)
+	if err != nil {
+		panic(err)
+	}
+	return formulas
+}
+
+// Load reads and compiles a JSON formulas file. A file formula replaces the default formula with the same
+// name and origin, a disabled one only removes it.
+func Load(path string) (Formulas, error) {
+	var formulas Formulas
+	if err := utils.LoadJSON(path, "derived metrics", &formulas); err != nil {
+		return nil, err
+	}
+	return compile(formulas)
+}
+
+func compile(formulas Formulas) (Formulas, error) {
+	var compiled Formulas
+	replaced := make(map[string]bool)
+	for idx, f := range formulas {
+		replaced[f.Name+"|"+f.Origin] = true
+		if f.Disabled {
+			continue
+		}
+		if err := f.compile(); err != nil {
+			return nil, fmt.Errorf("derived metric #%d: %v", idx+1, err)
+		}
+		compiled = append(compiled, f)
+	}
+
+	for _, f := range defaultFormulas {
+		if replaced[f.Name+"|"+f.Origin] {
+			continue
+		}
+		d := *f
+		if err := d.compile(); err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, &d)
+	}
+	return compiled, nil
+}
+
+func (f *Formula) compile() error {
+	var err error
+	if len(f.Name) == 0 {
+		return fmt.Errorf("'name' is required")
+	}
+
+	if len(f.Origin) > 0 {
+		if f.origin, err = glob.Compile(f.Origin); err != nil {
+			return fmt.Errorf("invalid origin '%s': %v", f.Origin, err)
+		}
+	}
+
+	p := &parser{input: f.Expression}
+	if f.expr, err = p.parse(); err != nil {
+		return fmt.Errorf("invalid expression '%s': %v", f.Expression, err)
+	}
+	f.fields = p.fields
+	return nil
+}
+
+// Eval computes the formula from the gauge values, it returns false when the formula doesn't apply to the
+// envelope or the result isn't a number (a zero quota...)
+func (f *Formula) Eval(origin string, values map[string]*loggregator_v2.GaugeValue) (float64, bool) {
+	if f.origin != nil && !f.origin.Match(origin) {
+		return 0, false
+	}
+	for _, field := range f.fields {
+		if _, ok := values[field]; !ok {
+			return 0, false
+		}
+	}
+
+	value := f.expr.eval(values)
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false
+	}
+	return value, true
+}
+
+// node of an expression, a number, a field or an operator
+type node struct {
+	op          byte
+	value       float64
+	field       string
+	left, right *node
+}
+
+const (
+	opNumber = 'n'
+	opField  = 'f'
+	opNegate = '~'
+)
+
+func (n *node) eval(values map[string]*loggregator_v2.GaugeValue) float64 {
+	switch n.op {
+	case opNumber:
+		return n.value
+	case opField:
+		return values[n.field].GetValue()
+	case opNegate:
+		return -n.left.eval(values)
+	case '+':
+		return n.left.eval(values) + n.right.eval(values)
+	case '-':
+		return n.left.eval(values) - n.right.eval(values)
+	case '*':
+		return n.left.eval(values) * n.right.eval(values)
+	default:
+		return n.left.eval(values) / n.right.eval(values)
+	}
+}
+
+// parser of the arithmetic expressions (+, -, *, / and parentheses) of numbers and gauge fields
+type parser struct {
+	input  string
+	pos    int
+	fields []string
+}
+
+func (p *parser) parse() (*node, error) {
+	n, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpaces(); p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected '%c' at %d", p.input[p.pos], p.pos+1)
+	}
+	return n, nil
+}
+
+func (p *parser) sum() (*node, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for p.skipSpaces(); p.pos < len(p.input) && (p.input[p.pos] == '+' || p.input[p.pos] == '-'); p.skipSpaces() {
+		op := p.input[p.pos]
+		p.pos++
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		left = &node{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) product() (*node, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.skipSpaces(); p.pos < len(p.input) && (p.input[p.pos] == '*' || p.input[p.pos] == '/'); p.skipSpaces() {
+		op := p.input[p.pos]
+		p.pos++
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = &node{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) factor() (*node, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.input) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	c := p.input[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		n, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.skipSpaces(); p.pos >= len(p.input) || p.input[p.pos] != ')' {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return n, nil
+	case c == '-':
+		p.pos++
+		n, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return &node{op: opNegate, left: n}, nil
+	case isDigit(c) || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && (isDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", p.input[start:p.pos])
+		}
+		return &node{op: opNumber, value: value}, nil
+	case isLetter(c):
+		// gauge names may contain dots, like 'system.cpu.user'
+		start := p.pos
+		for p.pos < len(p.input) && (isLetter(p.input[p.pos]) || isDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		field := p.input[start:p.pos]
+		p.fields = appendField(p.fields, field)
+		return &node{op: opField, field: field}, nil
+	default:
+		return nil, fmt.Errorf("unexpected '%c' at %d", c, p.pos+1)
+	}
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func appendField(fields []string, field string) []string {
+	for _, f := range fields {
+		if f == field {
+			return fields
+		}
+	}
+	return append(fields, field)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,82 @@
+package derived_test
+
+import (
+	"os"
+	"testing"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/derived"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/testutil"
+)
+
+func values(kv ...float64) map[string]*loggregator_v2.GaugeValue {
+	names := []string{"memory", "memory_quota", "disk", "disk_quota"}
+	m := make(map[string]*loggregator_v2.GaugeValue)
+	for i, v := range kv {
+		m[names[i]] = &loggregator_v2.GaugeValue{Value: v}
+	}
+	return m
+}
+
+func eval(formulas derived.Formulas, origin string, values map[string]*loggregator_v2.GaugeValue) map[string]float64 {
+	results := make(map[string]float64)
+	for _, f := range formulas {
+		if v, ok := f.Eval(origin, values); ok {
+			results[f.Name] = v
+		}
+	}
+	return results
+}
+
+func TestDefault(t *testing.T) {
+	formulas := derived.Default()
+	assert.Len(t, formulas, 3)
+
+	assert.Equal(t, map[string]float64{"memory_utilization": 25, "disk_utilization": 50}, eval(formulas, "rep", values(64, 256, 512, 1024)))
+	assert.Empty(t, eval(formulas, "bosh-system-metrics-forwarder", values(64, 256, 512, 1024)), "other origins")
+	assert.Equal(t, map[string]float64{"memory_utilization": 25}, eval(formulas, "rep", values(64, 256)), "missing fields")
+	assert.Equal(t, map[string]float64{"memory_utilization": 25}, eval(formulas, "rep", values(64, 256, 0, 0)), "zero quota")
+
+	entitlement := map[string]*loggregator_v2.GaugeValue{"absolute_usage": {Value: 30}, "absolute_entitlement": {Value: 120}}
+	assert.Equal(t, map[string]float64{"cpu_entitlement": 25}, eval(formulas, "rep", entitlement))
+}
+
+func TestLoad(t *testing.T) {
+	path := testutil.WriteFile(t, "derived-metrics", `[
+		{"name": "memory_utilization", "origin": "rep", "unit": "ratio", "expression": "memory / memory_quota"},
+		{"name": "disk_utilization", "origin": "rep", "disabled": true},
+		{"name": "memory_free", "unit": "bytes", "expression": "(memory_quota - memory) * -1 * -1"},
+		{"name": "mem_used", "origin": "bosh*", "expression": "system.mem.kb * 1024"}
+	]`)
+	defer os.Remove(path)
+
+	formulas, err := derived.Load(path)
+	assert.Nil(t, err)
+	assert.Len(t, formulas, 4)
+	assert.Equal(t, "ratio", formulas[0].Unit)
+
+	assert.Equal(t, map[string]float64{"memory_utilization": 0.25, "memory_free": 192}, eval(formulas, "rep", values(64, 256, 512, 1024)))
+	assert.Equal(t, map[string]float64{"mem_used": 2048}, eval(formulas, "bosh-system-metrics-forwarder", map[string]*loggregator_v2.GaugeValue{"system.mem.kb": {Value: 2}}))
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := derived.Load("/missing/derived-metrics.json")
+	assert.NotNil(t, err)
+
+	for _, formulas := range []string{
+		`{"name": "foo"}`,
+		`[{"expression": "memory"}]`,
+		`[{"name": "foo", "expression": ""}]`,
+		`[{"name": "foo", "expression": "memory /"}]`,
+		`[{"name": "foo", "expression": "(memory + disk"}]`,
+		`[{"name": "foo", "expression": "memory % disk"}]`,
+		`[{"name": "foo", "expression": "1.2.3 * memory"}]`,
+		`[{"name": "foo", "origin": "[", "expression": "memory"}]`,
+	} {
+		path := testutil.WriteFile(t, "derived-metrics", formulas)
+		_, err := derived.Load(path)
+		assert.NotNil(t, err, formulas)
+		os.Remove(path)
+	}
+}
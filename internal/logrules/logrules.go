@@ -0,0 +1,113 @@
+package logrules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/gobwas/glob"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// valueGroup is the regex named group holding the metric value
+const valueGroup = "value"
+
+// Rule extracts a metric from the log lines of the matching apps
+type Rule struct {
+	SourceID string            `json:"source_id"`
+	AppName  string            `json:"app_name"`
+	Regex    string            `json:"regex"`
+	Metric   string            `json:"metric"`
+	Tags     map[string]string `json:"tags"`
+
+	sourceID glob.Glob
+	appName  glob.Glob
+	regex    *regexp.Regexp
+}
+
+// Rules list of log extraction rules
+type Rules []*Rule
+
+// Load reads and compiles a JSON rules file
+func Load(path string) (Rules, error) {
+	var rules Rules
+	if err := utils.LoadJSON(path, "log rules", &rules); err != nil {
+		return nil, err
+	}
+
+	for idx, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("log rule #%d: %v", idx+1, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *Rule) compile() error {
+	var err error
+	if len(r.Metric) == 0 {
+		return fmt.Errorf("'metric' is required")
+	}
+
+	r.regex, err = regexp.Compile(r.Regex)
+	if err != nil {
+		return fmt.Errorf("invalid regex '%s': %v", r.Regex, err)
+	}
+
+	if len(r.SourceID) > 0 {
+		r.sourceID, err = glob.Compile(r.SourceID)
+		if err != nil {
+			return fmt.Errorf("invalid source_id '%s': %v", r.SourceID, err)
+		}
+	}
+
+	if len(r.AppName) > 0 {
+		r.appName, err = glob.Compile(r.AppName)
+		if err != nil {
+			return fmt.Errorf("invalid app_name '%s': %v", r.AppName, err)
+		}
+	}
+	return nil
+}
+
+// Match returns true if the rule applies to the app logs
+func (r *Rule) Match(sourceID, appName string) bool {
+	if r.sourceID != nil && !r.sourceID.Match(sourceID) {
+		return false
+	}
+	if r.appName != nil && !r.appName.Match(appName) {
+		return false
+	}
+	return true
+}
+
+// Extract applies the regex to the log line, the 'value' group is the metric value (1 if missing)
+// and any other named group is returned as a tag
+func (r *Rule) Extract(line string) (float64, map[string]string, bool) {
+	match := r.regex.FindStringSubmatch(line)
+	if match == nil {
+		return 0, nil, false
+	}
+
+	value := 1.0
+	tags := make(map[string]string, len(r.Tags))
+	for k, v := range r.Tags {
+		tags[k] = v
+	}
+
+	for idx, name := range r.regex.SubexpNames() {
+		if idx == 0 || len(name) == 0 {
+			continue
+		}
+		if name == valueGroup {
+			v, err := strconv.ParseFloat(match[idx], 64)
+			if err != nil {
+				return 0, nil, false
+			}
+			value = v
+		} else if len(match[idx]) > 0 {
+			tags[name] = match[idx]
+		}
+	}
+	return value, tags, true
+}
@@ -0,0 +1,57 @@
+package logrules_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/logrules"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/testutil"
+)
+
+func TestLoadAndExtract(t *testing.T) {
+	path := testutil.WriteFile(t, "log-rules", `[
+		{"app_name": "orders-*", "regex": "latency_ms=(?P<value>\\d+) status=(?P<status>\\w+)", "metric": "orders.latency", "tags": {"team": "shop"}},
+		{"source_id": "some-guid", "regex": "payment failed", "metric": "payments.failed"}
+	]`)
+	defer os.Remove(path)
+
+	rules, err := logrules.Load(path)
+	if err != nil {
+		assert.FailNow(t, "unable to load rules: ", err)
+	}
+	assert.Equal(t, 2, len(rules))
+
+	assert.True(t, rules[0].Match("any-guid", "orders-api"))
+	assert.False(t, rules[0].Match("any-guid", "payments-api"))
+	assert.True(t, rules[1].Match("some-guid", ""))
+	assert.False(t, rules[1].Match("other-guid", ""))
+
+	value, tags, ok := rules[0].Extract("GET /orders latency_ms=42 status=ok")
+	assert.True(t, ok)
+	assert.Equal(t, 42.0, value)
+	assert.Equal(t, map[string]string{"team": "shop", "status": "ok"}, tags)
+
+	_, _, ok = rules[0].Extract("GET /orders took a while")
+	assert.False(t, ok)
+
+	value, _, ok = rules[1].Extract("ERROR payment failed for order 123")
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, value)
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, rules := range []string{
+		`[{"regex": "(", "metric": "foo"}]`,
+		`[{"regex": "foo"}]`,
+		`{"regex": "foo", "metric": "foo"}`,
+	} {
+		path := testutil.WriteFile(t, "log-rules", rules)
+		_, err := logrules.Load(path)
+		assert.Error(t, err, rules)
+		os.Remove(path)
+	}
+
+	_, err := logrules.Load("/not/found.json")
+	assert.Error(t, err)
+}
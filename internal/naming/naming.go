@@ -0,0 +1,280 @@
+package naming
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// Metric kinds a rule applies to, an empty kind matches all of them
+const (
+	Gauge   = "gauge"
+	Counter = "counter"
+	Timer   = "timer"
+)
+
+// template variables, tags are referenced as {tag:<key>}
+const (
+	varPrefix = "prefix"
+	varOrigin = "origin"
+	varName   = "name"
+	varUnit   = "unit"
+	varTag    = "tag:"
+)
+
+// defaultRules reproduce the historical names, they are always applied after the file rules
+var defaultRules = []*Rule{
+	{Kind: Gauge, Tags: map[string]string{"source_id": "*"}, Template: "{prefix}.container.{origin}.{name}.{unit}"},
+	{Kind: Gauge, Template: "{prefix}.{origin}.{name}.{unit}"},
+	{Kind: Counter, Template: "{prefix}.{origin}.{name}"},
+	{Kind: Timer, Template: "{prefix}.{origin}.{name}.latency.ms"},
+}
+
+// defaultRename keeps the container metric names of the first nozzle versions
+var defaultRename = map[string]string{
+	"pcf.container.rep.cpu.percentage":     "pcf.container.rep.cpu_percentage",
+	"pcf.container.rep.disk.bytes":         "pcf.container.rep.disk_bytes",
+	"pcf.container.rep.disk_quota.bytes":   "pcf.container.rep.disk_bytes_quota",
+	"pcf.container.rep.memory.bytes":       "pcf.container.rep.memory_bytes",
+	"pcf.container.rep.memory_quota.bytes": "pcf.container.rep.memory_bytes_quota",
+}
+
+// Rule builds the name of the matching metrics from a template, conditions are globs
+// and a tag condition requires the tag to be present
+type Rule struct {
+	Kind     string            `json:"kind"`
+	Origin   string            `json:"origin"`
+	Name     string            `json:"name"`
+	Unit     string            `json:"unit"`
+	Tags     map[string]string `json:"tags"`
+	Template string            `json:"template"`
+
+	origin   glob.Glob
+	name     glob.Glob
+	unit     glob.Glob
+	tags     map[string]glob.Glob
+	segments [][]part
+	usesTags bool
+}
+
+// part is a literal, or a variable when 'variable' is set
+type part struct {
+	literal  string
+	variable string
+}
+
+// Rules naming rules, checked in order, and a rename table applied to the built names
+// (before the '.total' and '.delta' suffixes of the counters)
+type Rules struct {
+	Rules  []*Rule           `json:"rules"`
+	Rename map[string]string `json:"rename"`
+}
+
+// Default returns the historical naming rules
+func Default() *Rules {
+	rules := &Rules{}
+	if err := rules.compile(); err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// Load reads and compiles a JSON rules file, the default rules and renames are added after the file ones
+func Load(path string) (*Rules, error) {
+	rules := &Rules{}
+	if err := utils.LoadJSON(path, "naming rules", rules); err != nil {
+		return nil, err
+	}
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (rs *Rules) compile() error {
+	for idx, rule := range rs.Rules {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("naming rule #%d: %v", idx+1, err)
+		}
+	}
+
+	for _, rule := range defaultRules {
+		r := *rule
+		if err := r.compile(); err != nil {
+			return err
+		}
+		rs.Rules = append(rs.Rules, &r)
+	}
+
+	rename := make(map[string]string, len(defaultRename)+len(rs.Rename))
+	for k, v := range defaultRename {
+		rename[k] = v
+	}
+	for k, v := range rs.Rename {
+		rename[k] = v
+	}
+	rs.Rename = rename
+	return nil
+}
+
+func (r *Rule) compile() error {
+	var err error
+	switch r.Kind {
+	case "", Gauge, Counter, Timer:
+	default:
+		return fmt.Errorf("'%s' is not a valid kind (%s, %s or %s)", r.Kind, Gauge, Counter, Timer)
+	}
+
+	if r.origin, err = compileGlob("origin", r.Origin); err != nil {
+		return err
+	}
+	if r.name, err = compileGlob("name", r.Name); err != nil {
+		return err
+	}
+	if r.unit, err = compileGlob("unit", r.Unit); err != nil {
+		return err
+	}
+
+	r.tags = make(map[string]glob.Glob, len(r.Tags))
+	for k, v := range r.Tags {
+		if r.tags[k], err = compileGlob("tag '"+k+"' condition", v); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Template) == 0 {
+		return fmt.Errorf("'template' is required")
+	}
+	for _, segment := range strings.Split(r.Template, ".") {
+		parts, err := parseSegment(segment)
+		if err != nil {
+			return fmt.Errorf("invalid template '%s': %v", r.Template, err)
+		}
+		for _, p := range parts {
+			if strings.HasPrefix(p.variable, varTag) {
+				r.usesTags = true
+			}
+		}
+		r.segments = append(r.segments, parts)
+	}
+	return nil
+}
+
+// compileGlob returns nil for the patterns matching anything
+func compileGlob(field, pattern string) (glob.Glob, error) {
+	if len(pattern) == 0 || pattern == "*" {
+		return nil, nil
+	}
+	g, err := glob.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s '%s': %v", field, pattern, err)
+	}
+	return g, nil
+}
+
+func parseSegment(segment string) ([]part, error) {
+	var parts []part
+	for len(segment) > 0 {
+		start := strings.Index(segment, "{")
+		if start < 0 {
+			parts = append(parts, part{literal: segment})
+			break
+		}
+		if start > 0 {
+			parts = append(parts, part{literal: segment[:start]})
+		}
+
+		end := strings.Index(segment[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed '{'")
+		}
+		variable := segment[start+1 : start+end]
+		switch {
+		case variable == varPrefix, variable == varOrigin, variable == varName, variable == varUnit:
+		case strings.HasPrefix(variable, varTag) && len(variable) > len(varTag):
+		default:
+			return nil, fmt.Errorf("unknown variable '{%s}'", variable)
+		}
+		parts = append(parts, part{variable: variable})
+		segment = segment[start+end+1:]
+	}
+	return parts, nil
+}
+
+// Match returns the first rule matching the metric, the default rules match any metric of their kind
+func (rs *Rules) Match(kind, origin, name, unit string, tags map[string]string) *Rule {
+	for _, r := range rs.Rules {
+		if r.match(kind, origin, name, unit, tags) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *Rule) match(kind, origin, name, unit string, tags map[string]string) bool {
+	if len(r.Kind) > 0 && r.Kind != kind {
+		return false
+	}
+	if r.origin != nil && !r.origin.Match(origin) {
+		return false
+	}
+	if r.name != nil && !r.name.Match(name) {
+		return false
+	}
+	if r.unit != nil && !r.unit.Match(unit) {
+		return false
+	}
+	for k, g := range r.tags {
+		v, ok := tags[k]
+		if !ok || (g != nil && !g.Match(v)) {
+			return false
+		}
+	}
+	return true
+}
+
+// UsesTags returns true if the template references tags, so the name can't be cached by origin, name and unit
+func (r *Rule) UsesTags() bool {
+	return r.usesTags
+}
+
+// Name renders the rule template, segments that render empty are left out, then applies the rename table
+func (rs *Rules) Name(r *Rule, prefix, origin, name, unit string, tags map[string]string) string {
+	buf := make([]byte, 0, 64)
+	for _, segment := range r.segments {
+		start := len(buf)
+		if start > 0 {
+			buf = append(buf, '.')
+		}
+		written := len(buf)
+
+		for _, p := range segment {
+			switch p.variable {
+			case "":
+				buf = append(buf, p.literal...)
+			case varPrefix:
+				buf = append(buf, prefix...)
+			case varOrigin:
+				buf = append(buf, origin...)
+			case varName:
+				buf = append(buf, name...)
+			case varUnit:
+				buf = append(buf, unit...)
+			default:
+				buf = append(buf, tags[p.variable[len(varTag):]]...)
+			}
+		}
+
+		if len(buf) == written {
+			buf = buf[:start]
+		}
+	}
+
+	metricName := string(buf)
+	if newName, ok := rs.Rename[metricName]; ok {
+		return newName
+	}
+	return metricName
+}
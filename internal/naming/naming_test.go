@@ -0,0 +1,79 @@
+package naming_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/naming"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/testutil"
+)
+
+func name(rules *naming.Rules, kind, origin, name, unit string, tags map[string]string) string {
+	rule := rules.Match(kind, origin, name, unit, tags)
+	return rules.Name(rule, "pcf", origin, name, unit, tags)
+}
+
+func TestDefault(t *testing.T) {
+	rules := naming.Default()
+	container := map[string]string{"source_id": "some-guid"}
+
+	assert.Equal(t, "pcf.bosh.system.cpu.user.percent", name(rules, naming.Gauge, "bosh", "system.cpu.user", "percent", nil))
+	assert.Equal(t, "pcf.uptime", name(rules, naming.Gauge, "", "uptime", "", nil))
+	assert.Equal(t, "pcf.container.rep.cpu_percentage", name(rules, naming.Gauge, "rep", "cpu", "percentage", container))
+	assert.Equal(t, "pcf.container.rep.absolute_usage.nanoseconds", name(rules, naming.Gauge, "rep", "absolute_usage", "nanoseconds", container))
+	assert.Equal(t, "pcf.gorouter.total_requests", name(rules, naming.Counter, "gorouter", "total_requests", "", nil))
+	assert.Equal(t, "pcf.gorouter.http.latency.ms", name(rules, naming.Timer, "gorouter", "http", "", nil))
+}
+
+func TestLoad(t *testing.T) {
+	path := testutil.WriteFile(t, "naming-rules", `{
+		"rules": [
+			{"kind": "gauge", "origin": "rep", "tags": {"source_id": "*"}, "template": "{prefix}.container.{name}_{unit}"},
+			{"origin": "gorouter", "name": "total_*", "template": "{prefix}.router.{tag:job}.{name}"},
+			{"kind": "counter", "unit": "", "template": "{prefix}.{origin}.{name}"}
+		],
+		"rename": {"pcf.container.memory_bytes": "pcf.container.rep.memory_bytes", "pcf.gorouter.bad_gateways": "pcf.router.502"}
+	}`)
+	defer os.Remove(path)
+
+	rules, err := naming.Load(path)
+	if err != nil {
+		assert.FailNow(t, "unable to load rules: ", err)
+	}
+
+	container := map[string]string{"source_id": "some-guid"}
+	assert.Equal(t, "pcf.container.cpu_percentage", name(rules, naming.Gauge, "rep", "cpu", "percentage", container))
+	assert.Equal(t, "pcf.container.rep.memory_bytes", name(rules, naming.Gauge, "rep", "memory", "bytes", container))
+	assert.Equal(t, "pcf.rep.cpu.percentage", name(rules, naming.Gauge, "rep", "cpu", "percentage", nil), "the default rules still apply")
+
+	rule := rules.Match(naming.Counter, "gorouter", "total_requests", "", map[string]string{"job": "router"})
+	assert.True(t, rule.UsesTags())
+	assert.Equal(t, "pcf.router.router.total_requests", rules.Name(rule, "pcf", "gorouter", "total_requests", "", map[string]string{"job": "router"}))
+	assert.Equal(t, "pcf.router.total_requests", rules.Name(rule, "pcf", "gorouter", "total_requests", "", nil), "empty segments are left out")
+
+	assert.Equal(t, "pcf.router.502", name(rules, naming.Counter, "gorouter", "bad_gateways", "", nil))
+	assert.Equal(t, "pcf.container.rep.disk_bytes", rules.Rename["pcf.container.rep.disk.bytes"], "the default renames still apply")
+}
+
+func TestLoadErrors(t *testing.T) {
+	invalid := []string{
+		`not json`,
+		`{"rules": [{"origin": "rep"}]}`,
+		`{"rules": [{"kind": "histogram", "template": "{name}"}]}`,
+		`{"rules": [{"name": "[", "template": "{name}"}]}`,
+		`{"rules": [{"tags": {"job": "["}, "template": "{name}"}]}`,
+		`{"rules": [{"template": "{prefix}.{foo}"}]}`,
+		`{"rules": [{"template": "{prefix}.{tag:}"}]}`,
+		`{"rules": [{"template": "{prefix}.{name"}]}`,
+	}
+	for _, rules := range invalid {
+		path := testutil.WriteFile(t, "naming-rules", rules)
+		_, err := naming.Load(path)
+		os.Remove(path)
+		assert.NotNil(t, err, rules)
+	}
+
+	_, err := naming.Load("missing-naming-rules.json")
+	assert.NotNil(t, err)
+}
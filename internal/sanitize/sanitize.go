@@ -0,0 +1,183 @@
+package sanitize
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// Wavefront limits, a point tag limit is on its key and value together
+const (
+	maxNameLength   = 256
+	maxSourceLength = 128
+	maxTagLength    = 254
+	maxTagKeyLength = maxTagLength / 2
+)
+
+// Fixes counted by the sanitizer
+const (
+	NameChars     = "name_chars"
+	NameLength    = "name_length"
+	SourceLength  = "source_length"
+	TagKeyChars   = "tag_key_chars"
+	TagKeyEmpty   = "tag_key_empty"
+	TagValueEmpty = "tag_value_empty"
+	TagLength     = "tag_length"
+	// TagKeyCollision is a repaired key equal to another key, the repaired tag is dropped
+	TagKeyCollision = "tag_key_collision"
+)
+
+var fixes = []string{NameChars, NameLength, SourceLength, TagKeyChars, TagKeyEmpty, TagValueEmpty, TagLength, TagKeyCollision}
+
+// name prefixes allowed by Wavefront: internal metrics, and the two delta counter symbols
+var namePrefixes = []string{"~", "∆", "Δ"}
+
+// Sanitizer repairs the metric names, sources and point tags Wavefront would reject. Invalid characters
+// are replaced with '_', values too long are truncated and tags with empty values are dropped. A repaired
+// tag key equal to a valid key, or to another repaired key, is dropped.
+// It's safe for concurrent use.
+type Sanitizer struct {
+	fixes map[string]metrics.Counter
+}
+
+// New creates a Sanitizer, the fixes are counted by kind with 'tags'
+func New(tags map[string]string) *Sanitizer {
+	s := &Sanitizer{fixes: make(map[string]metrics.Counter, len(fixes))}
+	for _, fix := range fixes {
+		fixTags := utils.CopyTags(tags)
+		fixTags["fix"] = fix
+		s.fixes[fix] = utils.NewCounter("nozzle.sanitized", fixTags)
+	}
+	return s
+}
+
+// Name returns a valid metric name
+func (s *Sanitizer) Name(name string) string {
+	prefix := ""
+	for _, p := range namePrefixes {
+		if strings.HasPrefix(name, p) {
+			prefix = p
+			break
+		}
+	}
+
+	if !validChars(name[len(prefix):], validNameChar) {
+		s.fixes[NameChars].Inc(1)
+		name = prefix + replaceChars(name[len(prefix):], validNameChar)
+	}
+	if len(name) > maxNameLength {
+		s.fixes[NameLength].Inc(1)
+		name = truncate(name, maxNameLength)
+	}
+	return name
+}
+
+// Source returns a valid source
+func (s *Sanitizer) Source(source string) string {
+	if len(source) > maxSourceLength {
+		s.fixes[SourceLength].Inc(1)
+		return truncate(source, maxSourceLength)
+	}
+	return source
+}
+
+// Tags returns the tags unchanged when they are valid, or a repaired copy
+func (s *Sanitizer) Tags(tags map[string]string) map[string]string {
+	valid := true
+	for k, v := range tags {
+		if !validTag(k, v) {
+			valid = false
+			break
+		}
+	}
+	if valid {
+		return tags
+	}
+
+	// the valid tags are kept first, so they win the collisions with the repaired ones
+	sanitized := make(map[string]string, len(tags))
+	var repaired []string
+	for k, v := range tags {
+		switch {
+		case len(strings.TrimSpace(v)) == 0:
+			s.fixes[TagValueEmpty].Inc(1)
+		case len(k) == 0:
+			s.fixes[TagKeyEmpty].Inc(1)
+		case validTag(k, v):
+			sanitized[k] = v
+		default:
+			repaired = append(repaired, k)
+		}
+	}
+
+	// sorted, the same tag wins a collision whatever the map order
+	sort.Strings(repaired)
+	for _, k := range repaired {
+		v := tags[k]
+		if !validChars(k, validTagKeyChar) {
+			s.fixes[TagKeyChars].Inc(1)
+			k = replaceChars(k, validTagKeyChar)
+		}
+		if len(k)+len(v) > maxTagLength {
+			s.fixes[TagLength].Inc(1)
+			k = truncate(k, maxTagKeyLength)
+			v = truncate(v, maxTagLength-len(k))
+		}
+		if _, ok := sanitized[k]; ok {
+			s.fixes[TagKeyCollision].Inc(1)
+			continue
+		}
+		sanitized[k] = v
+	}
+	return sanitized
+}
+
+func validTag(k, v string) bool {
+	return len(k) > 0 && len(k)+len(v) <= maxTagLength && len(strings.TrimSpace(v)) > 0 && validChars(k, validTagKeyChar)
+}
+
+// validNameChar allows the characters of the SDK: letters, digits, '_', ',', '-', '.' and '/'
+func validNameChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= ',' && c <= '9') || c == '_'
+}
+
+func validTagKeyChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-' || c == '.'
+}
+
+func validChars(s string, valid func(byte) bool) bool {
+	for i := 0; i < len(s); i++ {
+		if !valid(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceChars replaces every invalid character, not every byte, with '_'
+func replaceChars(s string, valid func(byte) bool) string {
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for _, r := range s {
+		if r < utf8.RuneSelf && valid(byte(r)) {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+// truncate cuts s to at most n bytes, without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
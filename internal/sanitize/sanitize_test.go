@@ -0,0 +1,112 @@
+package sanitize_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/sanitize"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+func fixes(kind string) int64 {
+	return utils.NewCounter("nozzle.sanitized", map[string]string{"fix": kind}).Count()
+}
+
+// snapshot returns the fixes counted so far by kind, the counters are shared by the tests
+func snapshot() map[string]int64 {
+	counts := make(map[string]int64)
+	for _, kind := range []string{sanitize.NameChars, sanitize.NameLength, sanitize.SourceLength, sanitize.TagKeyChars,
+		sanitize.TagKeyEmpty, sanitize.TagValueEmpty, sanitize.TagLength, sanitize.TagKeyCollision} {
+		counts[kind] = fixes(kind)
+	}
+	return counts
+}
+
+func TestName(t *testing.T) {
+	s := sanitize.New(nil)
+	before := snapshot()
+
+	assert.Equal(t, "pcf.container.rep.cpu_percentage", s.Name("pcf.container.rep.cpu_percentage"))
+	assert.Equal(t, "~pcf.internal", s.Name("~pcf.internal"))
+	assert.Equal(t, "∆pcf.requests", s.Name("∆pcf.requests"))
+	assert.Equal(t, int64(0), fixes(sanitize.NameChars)-before[sanitize.NameChars])
+
+	assert.Equal(t, "pcf.app_name.r_sum_.time", s.Name("pcf.app name.résumé.time"))
+	assert.Equal(t, "pcf_metric", s.Name("pcf~metric"))
+	assert.Equal(t, int64(2), fixes(sanitize.NameChars)-before[sanitize.NameChars])
+
+	assert.Len(t, s.Name(strings.Repeat("a", 300)), 256)
+	assert.Equal(t, int64(1), fixes(sanitize.NameLength)-before[sanitize.NameLength])
+}
+
+func TestSource(t *testing.T) {
+	s := sanitize.New(nil)
+	before := snapshot()
+	assert.Equal(t, "10.0.0.1", s.Source("10.0.0.1"))
+	assert.Len(t, s.Source(strings.Repeat("a", 200)), 128)
+
+	// a multibyte character isn't split
+	source := s.Source(strings.Repeat("a", 127) + "é")
+	assert.Equal(t, strings.Repeat("a", 127), source)
+	assert.Equal(t, int64(2), fixes(sanitize.SourceLength)-before[sanitize.SourceLength])
+}
+
+func TestTags(t *testing.T) {
+	s := sanitize.New(nil)
+	before := snapshot()
+
+	tags := map[string]string{"deployment": "cf", "source_id": "some-guid", "app.name": "foo bar"}
+	assert.Equal(t, tags, s.Tags(tags))
+	assert.Equal(t, 0.0, testing.AllocsPerRun(100, func() {
+		s.Tags(tags)
+	}), "valid tags aren't copied")
+
+	long := strings.Repeat("v", 300)
+	tags = map[string]string{
+		"deployment": "cf",
+		"empty":      "",
+		"blank":      "  ",
+		"":           "no key",
+		"user agent": "curl",
+		"uri":        long,
+		"request/id": "1",
+	}
+	sanitized := s.Tags(tags)
+	assert.Equal(t, "cf", sanitized["deployment"])
+	assert.Equal(t, "curl", sanitized["user_agent"])
+	assert.Equal(t, "1", sanitized["request_id"])
+	assert.Equal(t, long[:251], sanitized["uri"])
+	assert.Len(t, sanitized, 4)
+	assert.Len(t, tags, 7, "the caller tags are unchanged")
+
+	assert.Equal(t, int64(2), fixes(sanitize.TagValueEmpty)-before[sanitize.TagValueEmpty])
+	assert.Equal(t, int64(1), fixes(sanitize.TagKeyEmpty)-before[sanitize.TagKeyEmpty])
+	assert.Equal(t, int64(2), fixes(sanitize.TagKeyChars)-before[sanitize.TagKeyChars])
+	assert.Equal(t, int64(1), fixes(sanitize.TagLength)-before[sanitize.TagLength])
+
+	sanitized = s.Tags(map[string]string{strings.Repeat("k", 300): "value"})
+	for k, v := range sanitized {
+		assert.Len(t, k, 127)
+		assert.Equal(t, "value", v)
+	}
+}
+
+func TestTagKeyCollisions(t *testing.T) {
+	s := sanitize.New(nil)
+	before := snapshot()
+
+	// the valid key wins, whatever the map order
+	for i := 0; i < 10; i++ {
+		sanitized := s.Tags(map[string]string{"user agent": "curl", "user_agent": "wget", "user/agent": "httpie"})
+		assert.Equal(t, map[string]string{"user_agent": "wget"}, sanitized)
+	}
+	assert.Equal(t, int64(20), fixes(sanitize.TagKeyCollision)-before[sanitize.TagKeyCollision])
+
+	// between repaired keys, the first one in order
+	for i := 0; i < 10; i++ {
+		sanitized := s.Tags(map[string]string{"user agent": "curl", "user/agent": "httpie"})
+		assert.Equal(t, map[string]string{"user_agent": "curl"}, sanitized)
+	}
+	assert.Equal(t, int64(30), fixes(sanitize.TagKeyCollision)-before[sanitize.TagKeyCollision])
+}
@@ -0,0 +1,410 @@
+package spill
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const segmentSuffix = ".seg"
+
+// cursorFile holds the read position, the sequence and offset of the next record to read
+const cursorFile = "cursor"
+
+// cursorSaveInterval is the number of records read between two writes of the cursor,
+// the records read since the last write are replayed after a crash
+const cursorSaveInterval = 1000
+
+// maxRecordSize protects from corrupted record headers
+const maxRecordSize = 64 * 1024 * 1024
+
+// ErrFull is returned by Push when the queue reached its max size
+var ErrFull = errors.New("spill queue is full")
+
+// ErrEmpty is returned by Pop when there are no records in the queue
+var ErrEmpty = errors.New("spill queue is empty")
+
+// Queue is a bounded FIFO of records stored on disk in length-delimited segment files.
+// Records left unread on disk are replayed after a restart, the read position is kept in a cursor file
+// written every cursorSaveInterval records and on Close.
+type Queue struct {
+	mutex sync.Mutex
+
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	segments []int64         // segment sequence numbers, oldest first
+	sizes    map[int64]int64 // bytes written per segment
+	size     int64           // bytes not read yet
+	count    int64
+	nextSeq  int64
+
+	w *os.File
+
+	r       *os.File
+	rSeq    int64
+	rOffset int64
+
+	cursor  *os.File
+	unsaved int   // records read since the cursor was written
+	peeked  int64 // length of the record returned by Peek, 0 when unknown
+}
+
+// Open creates the queue on 'dir', loading the segments from a previous run
+func Open(dir string, maxBytes int64) (*Queue, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid spill queue max size: %d", maxBytes)
+	}
+	var err error
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: maxBytes / 16,
+		sizes:        make(map[int64]int64),
+		rSeq:         -1,
+	}
+
+	q.cursor, err = os.OpenFile(filepath.Join(dir, cursorFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	cursorSeq, cursorOffset := q.readCursor()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, seq)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	// the segments before the cursor were read before the restart
+	for len(q.segments) > 0 && q.segments[0] < cursorSeq {
+		os.Remove(q.segmentPath(q.segments[0]))
+		q.segments = q.segments[1:]
+	}
+
+	for _, seq := range q.segments {
+		from := int64(0)
+		if seq == cursorSeq {
+			from = cursorOffset
+		}
+		count, unread, size, err := q.scanSegment(seq, from)
+		if err != nil {
+			return nil, err
+		}
+		q.count += count
+		q.size += unread
+		q.sizes[seq] = size
+		q.nextSeq = seq + 1
+	}
+	// new segments are never numbered like the one of the cursor
+	if q.nextSeq <= cursorSeq {
+		q.nextSeq = cursorSeq + 1
+	}
+	q.rSeq, q.rOffset = cursorSeq, cursorOffset
+	return q, nil
+}
+
+// scanSegment counts the complete records of a segment from the offset 'from', truncating any partial
+// record at its end. It returns the count and size of the unread records, and the segment size.
+func (q *Queue) scanSegment(seq, from int64) (int64, int64, int64, error) {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_RDWR, 0644)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	var count, unread, offset int64
+	for {
+		_, n, err := readRecord(f, offset)
+		if err != nil {
+			break
+		}
+		if offset >= from {
+			count++
+			unread += n
+		}
+		offset += n
+	}
+	return count, unread, offset, f.Truncate(offset)
+}
+
+func (q *Queue) readCursor() (int64, int64) {
+	buf := make([]byte, 16)
+	if n, _ := q.cursor.ReadAt(buf, 0); n < len(buf) {
+		return -1, 0
+	}
+	return int64(binary.BigEndian.Uint64(buf)), int64(binary.BigEndian.Uint64(buf[8:]))
+}
+
+// saveCursor writes the read position, it's synced to disk with the segments on Close
+func (q *Queue) saveCursor() error {
+	q.unsaved = 0
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(q.rSeq))
+	binary.BigEndian.PutUint64(buf[8:], uint64(q.rOffset))
+	_, err := q.cursor.WriteAt(buf, 0)
+	return err
+}
+
+// Push appends a record to the queue
+func (q *Queue) Push(data []byte) error {
+	header := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	header = header[:binary.PutUvarint(header, uint64(len(data)))]
+	record := append(header, data...)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.size+int64(len(record)) > q.maxBytes {
+		return ErrFull
+	}
+
+	if q.w == nil || q.sizes[q.nextSeq-1] >= q.segmentBytes {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	seq := q.nextSeq - 1
+	if _, err := q.w.Write(record); err != nil {
+		return err
+	}
+	q.sizes[seq] += int64(len(record))
+	q.size += int64(len(record))
+	q.count++
+	return nil
+}
+
+// rotate closes the current segment and starts a new one
+func (q *Queue) rotate() error {
+	if q.w != nil {
+		q.w.Close()
+	}
+
+	seq := q.nextSeq
+	w, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		q.w = nil
+		return err
+	}
+	q.w = w
+	q.segments = append(q.segments, seq)
+	q.sizes[seq] = 0
+	q.nextSeq++
+	return nil
+}
+
+// Pop removes and returns the oldest record, ErrEmpty if there are none
+func (q *Queue) Pop() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	data, n, err := q.peek()
+	if err != nil {
+		return nil, err
+	}
+	return data, q.advance(n)
+}
+
+// Peek returns the oldest record without removing it, ErrEmpty if there are none
+func (q *Queue) Peek() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	data, n, err := q.peek()
+	if err != nil {
+		return nil, err
+	}
+	q.peeked = n
+	return data, nil
+}
+
+// Discard removes the oldest record, usually once the record returned by Peek was handled
+func (q *Queue) Discard() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	n := q.peeked
+	if n == 0 {
+		var err error
+		if _, n, err = q.peek(); err != nil {
+			return err
+		}
+	}
+	return q.advance(n)
+}
+
+// peek reads the record at the read position, and its length on disk, skipping the segments read to the end
+func (q *Queue) peek() ([]byte, int64, error) {
+	for q.count > 0 && len(q.segments) > 0 {
+		seq := q.segments[0]
+		if q.r == nil || q.rSeq != seq {
+			r, err := os.Open(q.segmentPath(seq))
+			if err != nil {
+				return nil, 0, err
+			}
+			// the cursor of a previous run points inside the first segment
+			if q.rSeq != seq {
+				q.rOffset = 0
+			}
+			q.r, q.rSeq = r, seq
+		}
+
+		data, n, err := readRecord(q.r, q.rOffset)
+		if err == nil {
+			return data, n, nil
+		}
+
+		// end of a segment, or a corrupted one
+		if q.w != nil && seq == q.nextSeq-1 {
+			return nil, 0, err
+		}
+		q.removeSegment(seq)
+	}
+	q.reset()
+	return nil, 0, ErrEmpty
+}
+
+// advance moves the read position past the record of length 'n', the cursor is written every cursorSaveInterval records
+func (q *Queue) advance(n int64) error {
+	seq := q.rSeq
+	q.rOffset += n
+	q.size -= n
+	q.count--
+	q.peeked = 0
+
+	q.unsaved++
+	if q.unsaved >= cursorSaveInterval {
+		if err := q.saveCursor(); err != nil {
+			return err
+		}
+	}
+	if q.count == 0 {
+		q.reset()
+	} else if q.rOffset >= q.sizes[seq] && seq != q.nextSeq-1 {
+		q.removeSegment(seq)
+	}
+	return nil
+}
+
+func (q *Queue) removeSegment(seq int64) {
+	unread := q.sizes[seq]
+	if q.rSeq == seq {
+		unread -= q.rOffset
+	}
+	if q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+	os.Remove(q.segmentPath(seq))
+	q.size -= unread
+	delete(q.sizes, seq)
+	q.segments = q.segments[1:]
+}
+
+// reset removes all the segments once every record was read
+func (q *Queue) reset() {
+	if q.w != nil {
+		q.w.Close()
+		q.w = nil
+	}
+	for len(q.segments) > 0 {
+		q.removeSegment(q.segments[0])
+	}
+	q.size = 0
+	q.count = 0
+}
+
+// Len returns the number of records in the queue
+func (q *Queue) Len() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.count
+}
+
+// Size returns the queue size in bytes
+func (q *Queue) Size() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.size
+}
+
+// Close writes the cursor, then syncs and closes the segment and cursor files, pending records stay on disk
+func (q *Queue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+
+	var err error
+	if q.w != nil {
+		if err = q.w.Sync(); err == nil {
+			err = q.w.Close()
+		} else {
+			q.w.Close()
+		}
+		q.w = nil
+	}
+	if q.cursor != nil {
+		cerr := q.saveCursor()
+		if cerr == nil {
+			cerr = q.cursor.Sync()
+		}
+		if err == nil {
+			err = cerr
+		}
+		q.cursor.Close()
+		q.cursor = nil
+	}
+	return err
+}
+
+func (q *Queue) segmentPath(seq int64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// readRecord reads the record at 'offset' and returns it with its length on disk
+func readRecord(r io.ReaderAt, offset int64) ([]byte, int64, error) {
+	header := make([]byte, binary.MaxVarintLen64)
+	n, err := r.ReadAt(header, offset)
+	if n == 0 {
+		return nil, 0, err
+	}
+
+	size, hn := binary.Uvarint(header[:n])
+	if hn <= 0 || size > maxRecordSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, offset+int64(hn)); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	return data, int64(hn) + int64(size), nil
+}
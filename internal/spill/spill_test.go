@@ -0,0 +1,169 @@
+package spill_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/spill"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		assert.FailNow(t, "unable to create temp dir: ", err)
+	}
+	return dir
+}
+
+func segments(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	return files
+}
+
+func TestPushPop(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := spill.Open(dir, 1024)
+	if err != nil {
+		assert.FailNow(t, "unable to open queue: ", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, q.Push([]byte(fmt.Sprintf("record-%d", i))))
+	}
+	assert.Equal(t, int64(10), q.Len())
+
+	for i := 0; i < 10; i++ {
+		data, err := q.Pop()
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("record-%d", i), string(data))
+	}
+
+	_, err = q.Pop()
+	assert.Equal(t, spill.ErrEmpty, err)
+	assert.Equal(t, int64(0), q.Size())
+
+	assert.Equal(t, 0, len(segments(dir)), "segments are removed once read")
+}
+
+func TestMaxSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, _ := spill.Open(dir, 100)
+	record := make([]byte, 29)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, q.Push(record))
+	}
+	assert.Equal(t, spill.ErrFull, q.Push(record))
+	assert.Equal(t, int64(90), q.Size())
+
+	q.Pop()
+	assert.Equal(t, int64(60), q.Size(), "records read are not counted")
+	assert.Nil(t, q.Push(record))
+}
+
+func TestReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, _ := spill.Open(dir, 1024)
+	for i := 0; i < 5; i++ {
+		q.Push([]byte(fmt.Sprintf("record-%d", i)))
+	}
+	q.Pop()
+	q.Close()
+
+	// partial record at the end of the last segment
+	files := segments(dir)
+	f, _ := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{20, 'x'})
+	f.Close()
+
+	q, err := spill.Open(dir, 1024)
+	if err != nil {
+		assert.FailNow(t, "unable to reopen queue: ", err)
+	}
+	assert.Equal(t, int64(4), q.Len(), "records already read are not replayed after a restart")
+	assert.Equal(t, int64(36), q.Size())
+
+	data, _ := q.Pop()
+	assert.Equal(t, "record-1", string(data))
+	q.Push([]byte("record-5"))
+
+	var last []byte
+	for {
+		data, err := q.Pop()
+		if err != nil {
+			break
+		}
+		last = data
+	}
+	assert.Equal(t, "record-5", string(last))
+}
+
+func TestReopenReadSegments(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// 16 bytes segments, a segment per record
+	q, _ := spill.Open(dir, 256)
+	for i := 0; i < 5; i++ {
+		q.Push([]byte(fmt.Sprintf("record-%d...", i)))
+	}
+	for i := 0; i < 3; i++ {
+		q.Pop()
+	}
+	q.Close()
+
+	q, _ = spill.Open(dir, 256)
+	assert.Equal(t, int64(2), q.Len())
+	assert.Equal(t, 2, len(segments(dir)), "the segments read before the restart are removed")
+
+	data, _ := q.Pop()
+	assert.Equal(t, "record-3...", string(data))
+	q.Close()
+
+	// all the records read, the new segments are read from their start
+	q, _ = spill.Open(dir, 256)
+	q.Pop()
+	q.Push([]byte("record-5..."))
+	q.Close()
+
+	q, _ = spill.Open(dir, 256)
+	assert.Equal(t, int64(1), q.Len())
+	data, _ = q.Pop()
+	assert.Equal(t, "record-5...", string(data))
+}
+
+func TestPeekDiscard(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, _ := spill.Open(dir, 1024)
+	q.Push([]byte("record-0"))
+	q.Push([]byte("record-1"))
+
+	data, err := q.Peek()
+	assert.Nil(t, err)
+	assert.Equal(t, "record-0", string(data))
+	data, _ = q.Peek()
+	assert.Equal(t, "record-0", string(data), "a peeked record isn't removed")
+	assert.Equal(t, int64(2), q.Len())
+	q.Close()
+
+	q, _ = spill.Open(dir, 1024)
+	assert.Equal(t, int64(2), q.Len())
+	q.Peek()
+	assert.Nil(t, q.Discard())
+	data, _ = q.Pop()
+	assert.Equal(t, "record-1", string(data))
+	assert.Equal(t, spill.ErrEmpty, q.Discard())
+	q.Close()
+}
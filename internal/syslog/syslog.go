@@ -0,0 +1,225 @@
+package syslog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMessageSize protects from corrupted octet counting frames
+const maxMessageSize = 1024 * 1024
+
+// nilValue is the RFC 5424 placeholder for empty fields
+const nilValue = "-"
+
+// Element is a structured data element, like '[gauge@47450 name="cpu" value="0.5"]'
+type Element struct {
+	ID     string
+	Params map[string]string
+}
+
+// Message is a RFC 5424 syslog message
+type Message struct {
+	Priority       int
+	Timestamp      time.Time
+	Hostname       string
+	AppName        string
+	ProcID         string
+	MsgID          string
+	StructuredData []Element
+	Msg            string
+}
+
+// ReadFrame reads a message using octet counting framing ('<len> <msg>'),
+// or newline terminated framing if the frame doesn't start with a digit
+func ReadFrame(r *bufio.Reader) (string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	if b[0] < '0' || b[0] > '9' {
+		line, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil || size <= 0 || size > maxMessageSize {
+		return "", fmt.Errorf("invalid frame length '%s'", strings.TrimSpace(length))
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+// Parse parses a RFC 5424 message
+func Parse(data string) (*Message, error) {
+	p := &parser{data: data}
+	m := &Message{}
+
+	if !p.consume('<') {
+		return nil, errors.New("missing priority")
+	}
+	pri, err := strconv.Atoi(p.until('>'))
+	if err != nil || !p.consume('>') {
+		return nil, errors.New("invalid priority")
+	}
+	m.Priority = pri
+
+	if version := p.field(); version != "1" {
+		return nil, fmt.Errorf("unsupported version '%s'", version)
+	}
+
+	if ts := p.field(); ts != nilValue {
+		m.Timestamp, err = time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp '%s'", ts)
+		}
+	}
+
+	m.Hostname = optional(p.field())
+	m.AppName = optional(p.field())
+	m.ProcID = optional(p.field())
+	m.MsgID = optional(p.field())
+
+	m.StructuredData, err = p.structuredData()
+	if err != nil {
+		return nil, err
+	}
+
+	p.consume(' ')
+	m.Msg = p.data[p.pos:]
+	return m, nil
+}
+
+// Element returns the first structured data element with the given id
+func (m *Message) Element(id string) (Element, bool) {
+	for _, e := range m.StructuredData {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Element{}, false
+}
+
+func optional(value string) string {
+	if value == nilValue {
+		return ""
+	}
+	return value
+}
+
+type parser struct {
+	data string
+	pos  int
+}
+
+func (p *parser) consume(c byte) bool {
+	if p.pos < len(p.data) && p.data[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) until(c byte) string {
+	start := p.pos
+	for p.pos < len(p.data) && p.data[p.pos] != c {
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+// field reads a space separated header field
+func (p *parser) field() string {
+	value := p.until(' ')
+	p.consume(' ')
+	return value
+}
+
+func (p *parser) structuredData() ([]Element, error) {
+	if strings.HasPrefix(p.data[p.pos:], nilValue) {
+		p.pos += len(nilValue)
+		return nil, nil
+	}
+
+	var elements []Element
+	for p.consume('[') {
+		e := Element{ID: p.name(), Params: make(map[string]string)}
+		if len(e.ID) == 0 {
+			return nil, errors.New("missing structured data id")
+		}
+
+		for p.consume(' ') {
+			name := p.name()
+			if len(name) == 0 || !p.consume('=') || !p.consume('"') {
+				return nil, fmt.Errorf("invalid structured data param on '%s'", e.ID)
+			}
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			e.Params[name] = value
+		}
+
+		if !p.consume(']') {
+			return nil, fmt.Errorf("unterminated structured data element '%s'", e.ID)
+		}
+		elements = append(elements, e)
+	}
+
+	if len(elements) == 0 {
+		return nil, errors.New("missing structured data")
+	}
+	return elements, nil
+}
+
+// name reads a structured data id or param name
+func (p *parser) name() string {
+	start := p.pos
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c == ' ' || c == '=' || c == ']' || c == '"' {
+			break
+		}
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+// value reads a quoted param value, unescaping '\"', '\\' and '\]'
+func (p *parser) value() (string, error) {
+	var sb strings.Builder
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.pos < len(p.data) {
+				next := p.data[p.pos]
+				if next == '"' || next == '\\' || next == ']' {
+					c = next
+					p.pos++
+				}
+			}
+		}
+		sb.WriteByte(c)
+	}
+	return "", errors.New("unterminated structured data param value")
+}
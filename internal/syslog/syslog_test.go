@@ -0,0 +1,93 @@
+package syslog
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGauge(t *testing.T) {
+	m, err := Parse(`<14>1 2020-05-01T10:20:30.123456+00:00 org.space.app 6f6d1e4c-5a4f-4c36-9b5b-3a1a7c9d1b2e [1] - [gauge@47450 name="cpu" value="0.25" unit="percentage"][tags@47450 deployment="cf" job="diego-cell"]`)
+	assert.Nil(t, err)
+	assert.Equal(t, 14, m.Priority)
+	assert.Equal(t, time.Date(2020, 5, 1, 10, 20, 30, 123456000, time.UTC).UnixNano(), m.Timestamp.UnixNano())
+	assert.Equal(t, "org.space.app", m.Hostname)
+	assert.Equal(t, "6f6d1e4c-5a4f-4c36-9b5b-3a1a7c9d1b2e", m.AppName)
+	assert.Equal(t, "[1]", m.ProcID)
+	assert.Equal(t, "", m.MsgID)
+	assert.Len(t, m.StructuredData, 2)
+	assert.Equal(t, "", m.Msg)
+
+	gauge, ok := m.Element("gauge@47450")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"name": "cpu", "value": "0.25", "unit": "percentage"}, gauge.Params)
+
+	tags, ok := m.Element("tags@47450")
+	assert.True(t, ok)
+	assert.Equal(t, "diego-cell", tags.Params["job"])
+
+	_, ok = m.Element("counter@47450")
+	assert.False(t, ok)
+}
+
+func TestParseMessage(t *testing.T) {
+	m, err := Parse(`<14>1 2020-05-01T10:20:30Z host app [APP/PROC/WEB/0] - - hello world`)
+	assert.Nil(t, err)
+	assert.Empty(t, m.StructuredData)
+	assert.Equal(t, "hello world", m.Msg)
+
+	m, err = Parse(`<14>1 - - - - - [counter@47450 name="a\"b\]c\\" total="10" delta="1"] msg`)
+	assert.Nil(t, err)
+	assert.True(t, m.Timestamp.IsZero())
+	counter, _ := m.Element("counter@47450")
+	assert.Equal(t, `a"b]c\`, counter.Params["name"])
+	assert.Equal(t, "msg", m.Msg)
+}
+
+func TestParseErrors(t *testing.T) {
+	invalid := []string{
+		``,
+		`14>1 - - - - - -`,
+		`<x>1 - - - - - -`,
+		`<14>2 - - - - - -`,
+		`<14>1 yesterday - - - - -`,
+		`<14>1 - - - - -`,
+		`<14>1 - - - - - [gauge@47450 name="cpu"`,
+		`<14>1 - - - - - [gauge@47450 name=cpu]`,
+		`<14>1 - - - - - [gauge@47450 name="cpu]`,
+	}
+	for _, data := range invalid {
+		_, err := Parse(data)
+		assert.NotNil(t, err, data)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("11 <14>1 hello5 <14>1<14>1 line\r\n<14>1 last"))
+
+	frame, err := ReadFrame(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "<14>1 hello", frame)
+
+	frame, err = ReadFrame(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "<14>1", frame)
+
+	frame, err = ReadFrame(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "<14>1 line", frame)
+
+	frame, err = ReadFrame(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "<14>1 last", frame)
+
+	_, err = ReadFrame(r)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = ReadFrame(bufio.NewReader(strings.NewReader("99999999999 <14>1")))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,22 @@
+// Package testutil holds the helpers shared by the tests
+package testutil
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// WriteFile writes 'content' to a new temporary file and returns its path, the caller removes it
+func WriteFile(t *testing.T, prefix string, content string) string {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		assert.FailNow(t, "unable to create temp file: ", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		assert.FailNow(t, "unable to write temp file: ", err)
+	}
+	return f.Name()
+}
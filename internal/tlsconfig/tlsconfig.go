@@ -0,0 +1,72 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Options are the user provided TLS settings
+type Options struct {
+	CACertFile     string
+	CACert         string
+	ClientCertFile string
+	ClientKeyFile  string
+	MinVersion     string
+	SkipVerify     bool
+}
+
+// New builds the TLS configuration shared by all the nozzle clients
+func New(o Options) (*tls.Config, error) {
+	minVersion, ok := versions[o.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not a valid TLS version (1.0, 1.1, 1.2 or 1.3)", o.MinVersion)
+	}
+
+	conf := &tls.Config{
+		MinVersion:         minVersion,
+		InsecureSkipVerify: o.SkipVerify,
+	}
+
+	if len(o.CACertFile) > 0 || len(o.CACert) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if len(o.CACertFile) > 0 {
+			pem, err := ioutil.ReadFile(o.CACertFile)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found on CA file '%s'", o.CACertFile)
+			}
+		}
+		if len(o.CACert) > 0 && !pool.AppendCertsFromPEM([]byte(o.CACert)) {
+			return nil, fmt.Errorf("no certificates found on the CA bundle")
+		}
+		conf.RootCAs = pool
+	}
+
+	if len(o.ClientCertFile) > 0 || len(o.ClientKeyFile) > 0 {
+		if len(o.ClientCertFile) == 0 || len(o.ClientKeyFile) == 0 {
+			return nil, fmt.Errorf("both the client certificate and key files are required")
+		}
+		cert, err := tls.LoadX509KeyPair(o.ClientCertFile, o.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the client certificate: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
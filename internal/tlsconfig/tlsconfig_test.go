@@ -0,0 +1,105 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert creates a self-signed certificate and its key, returns the files paths and the cert PEM
+func writeCert(t *testing.T, dir string) (string, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nozzle-test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.Nil(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+	return certFile, keyFile, string(certPEM)
+}
+
+func TestDefaults(t *testing.T) {
+	conf, err := New(Options{MinVersion: "1.2"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), conf.MinVersion)
+	assert.False(t, conf.InsecureSkipVerify)
+	assert.Nil(t, conf.RootCAs)
+	assert.Empty(t, conf.Certificates)
+
+	conf, err = New(Options{MinVersion: "1.3", SkipVerify: true})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), conf.MinVersion)
+	assert.True(t, conf.InsecureSkipVerify)
+
+	_, err = New(Options{MinVersion: "2.0"})
+	assert.NotNil(t, err)
+}
+
+func TestCABundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsconfig")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, certPEM := writeCert(t, dir)
+
+	conf, err := New(Options{MinVersion: "1.2", CACertFile: certFile})
+	assert.Nil(t, err)
+	assert.NotNil(t, conf.RootCAs)
+
+	conf, err = New(Options{MinVersion: "1.2", CACert: certPEM})
+	assert.Nil(t, err)
+	assert.NotNil(t, conf.RootCAs)
+
+	_, err = New(Options{MinVersion: "1.2", CACert: "not a certificate"})
+	assert.NotNil(t, err)
+
+	_, err = New(Options{MinVersion: "1.2", CACertFile: keyFile})
+	assert.NotNil(t, err)
+
+	_, err = New(Options{MinVersion: "1.2", CACertFile: filepath.Join(dir, "missing.pem")})
+	assert.NotNil(t, err)
+}
+
+func TestClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsconfig")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, _ := writeCert(t, dir)
+
+	conf, err := New(Options{MinVersion: "1.2", ClientCertFile: certFile, ClientKeyFile: keyFile})
+	assert.Nil(t, err)
+	assert.Len(t, conf.Certificates, 1)
+
+	_, err = New(Options{MinVersion: "1.2", ClientCertFile: certFile})
+	assert.NotNil(t, err)
+
+	_, err = New(Options{MinVersion: "1.2", ClientCertFile: keyFile, ClientKeyFile: certFile})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,72 @@
+package uaa
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// tlsClient fetches client credentials tokens like uaago, using the shared TLS configuration
+type tlsClient struct {
+	tokenURL string
+	client   *http.Client
+}
+
+func newTLSClient(uaaURL string, tlsConfig *tls.Config) (*tlsClient, error) {
+	if len(uaaURL) == 0 {
+		return nil, fmt.Errorf("missing UAA url")
+	}
+	if _, err := url.Parse(uaaURL); err != nil {
+		return nil, err
+	}
+
+	return &tlsClient{
+		tokenURL: strings.TrimRight(uaaURL, "/") + "/oauth/token",
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig.Clone(),
+			},
+		},
+	}, nil
+}
+
+// GetAuthTokenWithExpiresIn returns the token and its lifetime in seconds, 'insecureSkipVerify' is already on the TLS configuration
+func (c *tlsClient) GetAuthTokenWithExpiresIn(username, password string, insecureSkipVerify bool) (string, int, error) {
+	data := url.Values{
+		"client_id":  {username},
+		"grant_type": {"client_credentials"},
+	}
+
+	req, err := http.NewRequest("POST", c.tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", -1, err
+	}
+	req.SetBasicAuth(username, password)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", -1, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", -1, fmt.Errorf("received a status code %v", res.Status)
+	}
+
+	var token struct {
+		TokenType   string  `json:"token_type"`
+		AccessToken string  `json:"access_token"`
+		ExpiresIn   float64 `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", -1, err
+	}
+	return fmt.Sprintf("%s %s", token.TokenType, token.AccessToken), int(token.ExpiresIn), nil
+}
@@ -0,0 +1,140 @@
+package uaa
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// maxRefreshMargin is how long before its expiration a token is refreshed
+const maxRefreshMargin = time.Minute
+
+// UAA provides cached auth tokens, refreshed ahead of their expiration
+type UAA interface {
+	GetAuthToken() (string, error)
+	RefreshAuthToken() (string, error)
+}
+
+type tokenClient interface {
+	GetAuthTokenWithExpiresIn(username, password string, insecureSkipVerify bool) (string, int, error)
+}
+
+type uaa struct {
+	uaaUser           string
+	uaaPass           string
+	skipSSLValidation bool
+	uaaClient         tokenClient
+	now               func() time.Time
+
+	mutex     sync.Mutex
+	token     string
+	fetchedAt time.Time
+	refreshAt time.Time
+	expiresAt time.Time
+
+	refreshes metrics.Counter
+	failures  metrics.Counter
+}
+
+// NewUAA creates a token provider, the tokens are fetched with the shared TLS configuration:
+// its CA bundle, client certificate and minimum TLS version
+func NewUAA(uaaURL string, uaaUser string, uaaPass string, tlsConfig *tls.Config, internalTags map[string]string) (UAA, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	uaaClient, err := newTLSClient(uaaURL, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newUAA(uaaClient, uaaUser, uaaPass, tlsConfig.InsecureSkipVerify, internalTags), nil
+}
+
+func newUAA(uaaClient tokenClient, uaaUser string, uaaPass string, skipSSLValidation bool, internalTags map[string]string) *uaa {
+	return &uaa{
+		uaaUser:           uaaUser,
+		uaaPass:           uaaPass,
+		skipSSLValidation: skipSSLValidation,
+		uaaClient:         uaaClient,
+		now:               time.Now,
+		refreshes:         utils.NewCounter("nozzle.uaa.refreshes", internalTags),
+		failures:          utils.NewCounter("nozzle.uaa.refresh.failures", internalTags),
+	}
+}
+
+// GetAuthToken returns the cached token, fetching a new one when it is about to expire.
+// Concurrent callers wait for a single refresh.
+func (uaa *uaa) GetAuthToken() (string, error) {
+	uaa.mutex.Lock()
+	defer uaa.mutex.Unlock()
+
+	if len(uaa.token) > 0 && uaa.now().Before(uaa.refreshAt) {
+		return uaa.token, nil
+	}
+	return uaa.refresh()
+}
+
+// RefreshAuthToken fetches a new token, unless it was already refreshed while waiting
+func (uaa *uaa) RefreshAuthToken() (string, error) {
+	requested := uaa.now()
+
+	uaa.mutex.Lock()
+	defer uaa.mutex.Unlock()
+
+	if len(uaa.token) > 0 && uaa.fetchedAt.After(requested) {
+		return uaa.token, nil
+	}
+	return uaa.refresh()
+}
+
+func (uaa *uaa) refresh() (string, error) {
+	token, expiresIn, err := uaa.uaaClient.GetAuthTokenWithExpiresIn(uaa.uaaUser, uaa.uaaPass, uaa.skipSSLValidation)
+	now := uaa.now()
+	if err != nil {
+		uaa.failures.Inc(1)
+		if len(uaa.token) > 0 && now.Before(uaa.expiresAt) {
+			utils.Logger.Printf("[ERROR] error refreshing the auth token, using the current one: %v", err)
+			return uaa.token, nil
+		}
+		return "", err
+	}
+	uaa.refreshes.Inc(1)
+
+	lifetime := time.Duration(expiresIn) * time.Second
+	margin := lifetime / 5
+	if margin > maxRefreshMargin {
+		margin = maxRefreshMargin
+	}
+
+	uaa.token = token
+	uaa.fetchedAt = now
+	uaa.expiresAt = now.Add(lifetime)
+	uaa.refreshAt = uaa.expiresAt.Add(-margin)
+	if utils.Debug {
+		utils.Logger.Printf("Auth token refreshed, expires in %v", lifetime)
+	}
+	return token, nil
+}
+
+// Transport sets the auth token on every request
+type Transport struct {
+	UAA  UAA
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.UAA.GetAuthToken()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", token)
+	return t.Base.RoundTrip(r)
+}
@@ -0,0 +1,174 @@
+package uaa
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockTokenClient struct {
+	calls     int32
+	expiresIn int
+	err       error
+	delay     time.Duration
+}
+
+func (c *mockTokenClient) GetAuthTokenWithExpiresIn(username, password string, insecureSkipVerify bool) (string, int, error) {
+	n := atomic.AddInt32(&c.calls, 1)
+	time.Sleep(c.delay)
+	if c.err != nil {
+		return "", -1, c.err
+	}
+	return fmt.Sprintf("bearer token-%d", n), c.expiresIn, nil
+}
+
+type clock struct {
+	mutex sync.Mutex
+	t     time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.t
+}
+
+func (c *clock) add(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestCachedToken(t *testing.T) {
+	client := &mockTokenClient{expiresIn: 600}
+	clk := &clock{t: time.Now()}
+	u := newUAA(client, "user", "pass", false, nil)
+	u.now = clk.now
+
+	token, err := u.GetAuthToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "bearer token-1", token)
+
+	clk.add(8 * time.Minute)
+	token, _ = u.GetAuthToken()
+	assert.Equal(t, "bearer token-1", token)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&client.calls))
+
+	// refreshed one minute before the expiration
+	clk.add(time.Minute + time.Second)
+	token, _ = u.GetAuthToken()
+	assert.Equal(t, "bearer token-2", token)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&client.calls))
+}
+
+func TestSingleFlight(t *testing.T) {
+	client := &mockTokenClient{expiresIn: 600, delay: 50 * time.Millisecond}
+	u := newUAA(client, "user", "pass", false, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := u.GetAuthToken()
+			assert.Nil(t, err)
+			assert.Equal(t, "bearer token-1", token)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&client.calls))
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.RefreshAuthToken()
+		}()
+	}
+	wg.Wait()
+	assert.True(t, atomic.LoadInt32(&client.calls) < 10)
+}
+
+func TestRefreshFailure(t *testing.T) {
+	client := &mockTokenClient{expiresIn: 600}
+	clk := &clock{t: time.Now()}
+	u := newUAA(client, "user", "pass", false, nil)
+	u.now = clk.now
+
+	failures := u.failures.Count()
+	u.GetAuthToken()
+	client.err = errors.New("uaa down")
+
+	// the current token is still valid
+	clk.add(9*time.Minute + 30*time.Second)
+	token, err := u.GetAuthToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "bearer token-1", token)
+
+	clk.add(time.Minute)
+	_, err = u.GetAuthToken()
+	assert.NotNil(t, err)
+	assert.Equal(t, failures+2, u.failures.Count())
+}
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	u := newUAA(&mockTokenClient{expiresIn: 600}, "user", "pass", false, nil)
+	client := &http.Client{Transport: &Transport{UAA: u, Base: http.DefaultTransport}}
+
+	res, err := client.Get(server.URL)
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, "bearer token-1", string(body))
+}
+
+func TestTLSClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if r.URL.Path != "/oauth/token" || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"token_type":"bearer","access_token":"abc","expires_in":43199}`))
+	}))
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	u, err := NewUAA(server.URL, "user", "pass", &tls.Config{RootCAs: pool}, nil)
+	assert.Nil(t, err)
+	token, err := u.GetAuthToken()
+	assert.Nil(t, err)
+	assert.Equal(t, "bearer abc", token)
+
+	// the server certificate is not trusted
+	u, err = NewUAA(server.URL, "user", "pass", &tls.Config{RootCAs: x509.NewCertPool()}, nil)
+	assert.Nil(t, err)
+	_, err = u.GetAuthToken()
+	assert.NotNil(t, err)
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	u, err := NewUAA("https://uaa.example.com", "user", "pass", &tls.Config{MinVersion: tls.VersionTLS12}, nil)
+	assert.Nil(t, err)
+	client, ok := u.(*uaa).uaaClient.(*tlsClient)
+	if assert.True(t, ok) {
+		assert.Equal(t, uint16(tls.VersionTLS12), client.client.Transport.(*http.Transport).TLSClientConfig.MinVersion)
+	}
+}
@@ -3,8 +3,12 @@ package utils
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/rcrowley/go-metrics"
 	"github.com/wavefronthq/go-metrics-wavefront/reporting"
@@ -50,10 +54,74 @@ func GetInternalTags() map[string]string {
 	return internalTags
 }
 
+// CopyTags returns a copy of the tags, to add metric specific tags to the internal ones
+func CopyTags(tags map[string]string) map[string]string {
+	copied := make(map[string]string, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return copied
+}
+
+// SeriesKey builds a unique and stable key for a metric name, source and tags
+func SeriesKey(name, source string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteString("|")
+	sb.WriteString(source)
+	for _, k := range keys {
+		sb.WriteString("|")
+		sb.WriteString(k)
+		sb.WriteString("=")
+		sb.WriteString(tags[k])
+	}
+	return sb.String()
+}
+
 // NewCounter creates and register internal metrics
 func NewCounter(name string, tags map[string]string) metrics.Counter {
 	return reporting.GetOrRegisterMetric(name, metrics.NewCounter(), tags).(metrics.Counter)
 }
 
+// Drain waits until the queue is empty, returns false if the timeout expires before
+func Drain(used func() int64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for used() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// SplitPair splits a 'key=value' entry on its last '=', the key may hold '=' but not the value.
+// 'format' describes the entry in the error, like 'pattern=budget'.
+func SplitPair(entry string, format string) (string, string, error) {
+	idx := strings.LastIndex(entry, "=")
+	if idx < 0 {
+		return "", "", fmt.Errorf("the format is '%s'", format)
+	}
+	return strings.TrimSpace(entry[:idx]), strings.TrimSpace(entry[idx+1:]), nil
+}
+
+// LoadJSON reads the JSON file at 'path' into 'v', 'what' names the file in the parsing errors
+func LoadJSON(path string, what string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing %s file '%s': %v", what, path, err)
+	}
+	return nil
+}
+
 var Logger = log.New(os.Stdout, "[WAVEFRONT] ", 0)
 var Debug = os.Getenv("WAVEFRONT_DEBUG") == "true"
@@ -3,8 +3,10 @@ package utils_test
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/testutil"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
 )
 
@@ -24,3 +26,43 @@ func TestGetVcapApp(t *testing.T) {
 	assert.Equal(t, "wavefront-firehose-nozzle-1.0.0", app.Name, "VCAP_APPLICATION")
 
 }
+
+func TestDrain(t *testing.T) {
+	queue := int64(3)
+	used := func() int64 {
+		if queue > 0 {
+			queue--
+		}
+		return queue
+	}
+	assert.True(t, utils.Drain(used, time.Second))
+
+	full := func() int64 { return 1 }
+	assert.False(t, utils.Drain(full, 100*time.Millisecond))
+}
+
+func TestLoadJSON(t *testing.T) {
+	path := testutil.WriteFile(t, "load-json", `{"name": "foo"}`)
+	defer os.Remove(path)
+
+	var v struct{ Name string }
+	assert.Nil(t, utils.LoadJSON(path, "test", &v))
+	assert.Equal(t, "foo", v.Name)
+
+	invalid := testutil.WriteFile(t, "load-json", `{"name": `)
+	defer os.Remove(invalid)
+	err := utils.LoadJSON(invalid, "test", &v)
+	assert.Contains(t, err.Error(), "error parsing test file '"+invalid+"'")
+
+	assert.NotNil(t, utils.LoadJSON(path+".missing", "test", &v))
+}
+
+func TestSplitPair(t *testing.T) {
+	key, value, err := utils.SplitPair(" pcf.*{a=b} = 10 ", "pattern=budget")
+	assert.Nil(t, err)
+	assert.Equal(t, "pcf.*{a=b}", key)
+	assert.Equal(t, "10", value)
+
+	_, _, err = utils.SplitPair("pcf.*", "pattern=budget")
+	assert.EqualError(t, err, "the format is 'pattern=budget'")
+}
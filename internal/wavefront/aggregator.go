@@ -0,0 +1,116 @@
+package wavefront
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/aggregation"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+	"github.com/wavefronthq/go-metrics-wavefront/reporting"
+)
+
+// aggregator collapses the points of the metrics matching an aggregation rule into the rule statistics
+// every rule window, the other data is sent as is
+type aggregator struct {
+	Wavefront
+	rules aggregation.Rules
+
+	mutex   sync.Mutex
+	windows map[*aggregation.Rule]map[string]*aggregation.Series
+
+	points metrics.Counter
+	done   chan struct{}
+}
+
+// newAggregator returns 'next' when there are no aggregation rules
+func newAggregator(next Wavefront, rules aggregation.Rules, internalTags map[string]string) Wavefront {
+	if len(rules) == 0 {
+		return next
+	}
+
+	ag := &aggregator{
+		Wavefront: next,
+		rules:     rules,
+		windows:   make(map[*aggregation.Rule]map[string]*aggregation.Series, len(rules)),
+		points:    utils.NewCounter("nozzle.aggregation.points", internalTags),
+		done:      make(chan struct{}),
+	}
+	for _, rule := range rules {
+		ag.windows[rule] = make(map[string]*aggregation.Series)
+		ag.start(rule)
+	}
+	reporting.RegisterMetric("nozzle.aggregation.series", metrics.NewFunctionalGauge(ag.size), internalTags)
+	return ag
+}
+
+func (ag *aggregator) start(rule *aggregation.Rule) {
+	ticker := time.NewTicker(rule.Window)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ag.flush(rule)
+			case <-ag.done:
+				return
+			}
+		}
+	}()
+}
+
+// SendMetric adds the point to the window of its series, the tags are copied as the callers reuse them
+func (ag *aggregator) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) {
+	rule := ag.rules.Match(name)
+	if rule == nil {
+		ag.Wavefront.SendMetric(name, value, ts, source, tags)
+		return
+	}
+
+	key := utils.SeriesKey(name, source, tags)
+
+	ag.mutex.Lock()
+	defer ag.mutex.Unlock()
+
+	s, ok := ag.windows[rule][key]
+	if !ok {
+		s = &aggregation.Series{Name: name, Source: source, Tags: utils.CopyTags(tags)}
+		ag.windows[rule][key] = s
+	}
+	s.Add(value, ts)
+	ag.points.Inc(1)
+}
+
+// flush sends the statistics of the rule window, timestamped with the latest point of each series
+func (ag *aggregator) flush(rule *aggregation.Rule) {
+	ag.mutex.Lock()
+	window := ag.windows[rule]
+	ag.windows[rule] = make(map[string]*aggregation.Series, len(window))
+	ag.mutex.Unlock()
+
+	for _, s := range window {
+		for _, stat := range rule.Stats {
+			ag.Wavefront.SendMetric(rule.Name(s.Name, stat), s.Value(stat), s.Timestamp(), s.Source, s.Tags)
+		}
+	}
+}
+
+func (ag *aggregator) size() int64 {
+	ag.mutex.Lock()
+	defer ag.mutex.Unlock()
+
+	var size int
+	for _, window := range ag.windows {
+		size += len(window)
+	}
+	return int64(size)
+}
+
+// Close sends the pending windows before closing the next sink
+func (ag *aggregator) Close() {
+	close(ag.done)
+	for _, rule := range ag.rules {
+		ag.flush(rule)
+	}
+	ag.Wavefront.Close()
+}
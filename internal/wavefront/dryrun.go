@@ -0,0 +1,69 @@
+package wavefront
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+	"github.com/wavefronthq/wavefront-sdk-go/senders"
+)
+
+// dryRunSender prints the Wavefront lines instead of sending them
+type dryRunSender struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func newDryRunSender(out io.Writer) senders.Sender {
+	return &dryRunSender{out: out}
+}
+
+func (s *dryRunSender) print(line string, err error) error {
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = fmt.Fprint(s.out, line)
+	return err
+}
+
+func (s *dryRunSender) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) error {
+	return s.print(senders.MetricLine(name, value, ts, source, tags, "dry-run"))
+}
+
+func (s *dryRunSender) SendDeltaCounter(name string, value float64, source string, tags map[string]string) error {
+	if !strings.HasPrefix(name, "\u2206") && !strings.HasPrefix(name, "\u0394") {
+		name = "\u2206" + name
+	}
+	return s.print(senders.MetricLine(name, value, 0, source, tags, "dry-run"))
+}
+
+func (s *dryRunSender) SendDistribution(name string, centroids []histogram.Centroid, hgs map[histogram.Granularity]bool, ts int64, source string, tags map[string]string) error {
+	return s.print(senders.HistoLine(name, centroids, hgs, ts, source, tags, "dry-run"))
+}
+
+func (s *dryRunSender) SendSpan(name string, startMillis, durationMillis int64, source, traceID, spanID string, parents, followsFrom []string, tags []senders.SpanTag, spanLogs []senders.SpanLog) error {
+	return s.print(senders.SpanLine(name, startMillis, durationMillis, source, traceID, spanID, parents, followsFrom, tags, spanLogs, "dry-run"))
+}
+
+func (s *dryRunSender) SendEvent(name string, startMillis, endMillis int64, source string, tags map[string]string, setters ...event.Option) error {
+	return s.print(senders.EventLine(name, startMillis, endMillis, source, tags, setters...))
+}
+
+func (s *dryRunSender) Flush() error {
+	return nil
+}
+
+func (s *dryRunSender) GetFailureCount() int64 {
+	return 0
+}
+
+func (s *dryRunSender) Start() {
+}
+
+func (s *dryRunSender) Close() {
+}
@@ -1,49 +1,187 @@
 package wavefront
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/cardinality"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/filter"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/sanitize"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
 	"github.com/wavefronthq/go-metrics-wavefront/reporting"
 	"github.com/wavefronthq/wavefront-sdk-go/application"
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
 	"github.com/wavefronthq/wavefront-sdk-go/senders"
 )
 
 var trace = os.Getenv("WAVEFRONT_TRACE") == "true"
 
+// pools holds the clients shared by the workers, by destination
+var (
+	poolsMutex sync.Mutex
+	pools      = make(map[string]*pool)
+)
+
+// reporter sends the internal metrics of the whole process with the sender of one of the pools,
+// 'reporterPool', guarded by poolsMutex
+var (
+	reporter     reporting.WavefrontMetricsReporter
+	reporterPool *pool
+)
+
+// pool is a client shared by all the workers sending to the same destination
+type pool struct {
+	wf     Wavefront
+	sender senders.Sender
+	refs   int
+}
+
+var minuteGranularity = map[histogram.Granularity]bool{histogram.MINUTE: true}
+
+// Wavefront sends the data points, the tags maps are not kept after the calls so the callers can reuse them
 type Wavefront interface {
 	SendMetric(name string, value float64, ts int64, source string, tags map[string]string)
+	SendDeltaCounter(name string, value float64, source string, tags map[string]string)
+	SendDistribution(name string, centroids []histogram.Centroid, ts int64, source string, tags map[string]string)
+	SendEvent(name string, ts int64, source string, tags map[string]string, setters ...event.Option)
 	ReportError(err error)
+	Close()
 }
 
 type wavefront struct {
 	sender    senders.Sender
 	hisSender senders.Sender
-	reporter  reporting.WavefrontMetricsReporter
 	filter    filter.Filter
+	sanitizer *sanitize.Sanitizer
+	limiter   *cardinality.Limiter
 
 	numMetricsSent     metrics.Counter
 	metricsSendFailure metrics.Counter
 	metricsFiltered    metrics.Counter
 	handleErrorMetric  metrics.Counter
+	numEventsSent      metrics.Counter
+	eventsSendFailure  metrics.Counter
 	sentTimeMetric     metrics.Histogram
+
+	done chan struct{}
 }
 
-func NewWavefront(conf *config.WavefrontConfig) Wavefront {
-	var sender, hisSender senders.Sender
-	var err error
+// sharedWavefront is a worker handle on a pooled client
+type sharedWavefront struct {
+	Wavefront
+	key  string
+	once sync.Once
+}
 
+// NewWavefront returns a handle on the client of the configured destination, its internal metrics are reported
+// with 'internalTags'. The senders, the health report and the aggregation windows are created by the first caller
+// with the same destination and tags, and closed with the last handle. The internal metrics reporter is created
+// with the first client, and closed with the last one.
+func NewWavefront(conf *config.WavefrontConfig, internalTags map[string]string) Wavefront {
 	if len(conf.ProxyAddr) == 0 {
 		conf.ProxyAddr = os.Getenv("PROXY_CONN_HOST")
 	}
+	key := destination(conf) + "|" + tagsKey(internalTags)
+
+	poolsMutex.Lock()
+	defer poolsMutex.Unlock()
 
-	if len(conf.URL) > 0 && len(conf.Token) > 0 {
+	p, ok := pools[key]
+	if !ok {
+		wf := newWavefront(conf, internalTags)
+		p = &pool{wf: newAggregator(wf, conf.Aggregations, internalTags), sender: wf.sender}
+		pools[key] = p
+		if reporter == nil {
+			startReporter(p)
+		}
+	}
+	p.refs++
+	return &sharedWavefront{Wavefront: p.wf, key: key}
+}
+
+// Close releases the handle, the last one flushes and closes the senders
+func (s *sharedWavefront) Close() {
+	s.once.Do(func() {
+		poolsMutex.Lock()
+		defer poolsMutex.Unlock()
+
+		p := pools[s.key]
+		p.refs--
+		if p.refs == 0 {
+			delete(pools, s.key)
+			if reporterPool == p {
+				stopReporter()
+				// the other clients keep reporting the internal metrics
+				for _, other := range pools {
+					startReporter(other)
+					break
+				}
+			}
+			p.wf.Close()
+		}
+	})
+}
+
+// startReporter reports the internal metrics with the sender of 'p'
+func startReporter(p *pool) {
+	reporter = reporting.NewReporter(
+		p.sender,
+		application.New("pcf-nozzle", "internal-metrics"),
+		reporting.Prefix("wavefront-firehose-nozzle.app"),
+	)
+	reporterPool = p
+}
+
+// stopReporter reports the internal metrics one last time
+func stopReporter() {
+	reporter.Report()
+	reporter.Close()
+	reporter = nil
+	reporterPool = nil
+}
+
+// destination identifies the senders of a configuration, the API token is hashed
+func destination(conf *config.WavefrontConfig) string {
+	switch {
+	case conf.DryRun:
+		return "dry-run"
+	case len(conf.URL) > 0 && len(conf.Token) > 0:
+		token := sha256.Sum256([]byte(strings.Trim(conf.Token, " ")))
+		return "direct:" + strings.Trim(conf.URL, " ") + ":" + hex.EncodeToString(token[:])
+	default:
+		return fmt.Sprintf("proxy:%s:%d:%d", strings.Trim(conf.ProxyAddr, " "), conf.ProxyPort, conf.ProxyHisToMinPort)
+	}
+}
+
+// tagsKey identifies the internal tags of a client
+func tagsKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func newWavefront(conf *config.WavefrontConfig, internalTags map[string]string) *wavefront {
+	var sender, hisSender senders.Sender
+	var err error
+
+	if conf.DryRun {
+		utils.Logger.Printf("Dry run, printing the metrics instead of sending them")
+		sender = newDryRunSender(os.Stdout)
+		hisSender = sender
+	} else if len(conf.URL) > 0 && len(conf.Token) > 0 {
 		utils.Logger.Printf("Direct connetion to Wavefront: %s", conf.URL)
 		directCfg := &senders.DirectConfiguration{
 			Server:               strings.Trim(conf.URL, " "),
@@ -52,6 +190,11 @@ func NewWavefront(conf *config.WavefrontConfig) Wavefront {
 			MaxBufferSize:        conf.MaxBufferSize,
 			FlushIntervalSeconds: conf.FlushInterval,
 		}
+		// the SDK direct sender has its own HTTP client, with no TLS options: a CA bundle or a client certificate
+		// can't be applied, so don't connect to a server they were meant to verify
+		if conf.TLS != nil && (conf.TLS.RootCAs != nil || len(conf.TLS.Certificates) > 0) {
+			utils.Logger.Fatal("[ERROR] The direct connection to Wavefront can't use a CA bundle or a client certificate, use a Wavefront proxy")
+		}
 		sender, err = senders.NewDirectSender(directCfg)
 		if err != nil {
 			utils.Logger.Fatal(err)
@@ -63,6 +206,7 @@ func NewWavefront(conf *config.WavefrontConfig) Wavefront {
 			MetricsPort:          conf.ProxyPort,
 			FlushIntervalSeconds: conf.FlushInterval,
 			DistributionPort:     conf.ProxyPort,
+			EventsPort:           conf.ProxyPort,
 		}
 		sender, err = senders.NewProxySender(proxyCfg)
 		if err != nil {
@@ -85,32 +229,34 @@ func NewWavefront(conf *config.WavefrontConfig) Wavefront {
 		utils.Logger.Fatal(errors.New("No Wavefront configuration detected"))
 	}
 
-	internalTags := utils.GetInternalTags()
 	utils.Logger.Printf("internalTags: %v", internalTags)
 
 	numMetricsSent := utils.NewCounter("total-metrics-sent", internalTags)
 	metricsSendFailure := utils.NewCounter("metrics-send-failure", internalTags)
 	metricsFiltered := utils.NewCounter("metrics-filtered", internalTags)
 	handleErrorMetric := utils.NewCounter("firehose-connection-error", internalTags)
+	numEventsSent := utils.NewCounter("total-events-sent", internalTags)
+	eventsSendFailure := utils.NewCounter("events-send-failure", internalTags)
 
 	sentTimeMetric := reporting.GetOrRegisterMetric("metrics-send-time", reporting.NewHistogram(), internalTags).(metrics.Histogram)
 
-	reporter := reporting.NewReporter(
-		sender,
-		application.New("pcf-nozzle", "internal-metrics"),
-		reporting.Prefix("wavefront-firehose-nozzle.app"),
-	)
-
 	wf := &wavefront{
 		sender:             sender,
 		hisSender:          hisSender,
 		filter:             filter.NewGlobFilter(conf.Filters),
-		reporter:           reporter,
+		sanitizer:          sanitize.New(internalTags),
 		numMetricsSent:     numMetricsSent,
 		metricsSendFailure: metricsSendFailure,
 		metricsFiltered:    metricsFiltered,
 		handleErrorMetric:  handleErrorMetric,
+		numEventsSent:      numEventsSent,
+		eventsSendFailure:  eventsSendFailure,
 		sentTimeMetric:     sentTimeMetric,
+		done:               make(chan struct{}),
+	}
+	if conf.Cardinality != nil {
+		wf.limiter = cardinality.NewLimiter(conf.Cardinality, internalTags)
+		wf.limiter.Start()
 	}
 	wf.startHealthReport()
 	return wf
@@ -118,6 +264,7 @@ func NewWavefront(conf *config.WavefrontConfig) Wavefront {
 
 func (w *wavefront) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) {
 	var err error
+	name, source, tags = w.sanitize(name, source, tags)
 	if trace {
 		line, err := senders.MetricLine(name, value, ts, source, tags, "")
 		if err != nil {
@@ -132,6 +279,11 @@ func (w *wavefront) SendMetric(name string, value float64, ts int64, source stri
 	}
 
 	if w.filter.Match(name, tags) {
+		tags, ok := w.limit(name, source, tags)
+		if !ok {
+			return
+		}
+
 		start := time.Now()
 		if w.filter.IsHistogramMetric(name) {
 			err = w.hisSender.SendMetric(name, value, ts, source, tags)
@@ -153,11 +305,120 @@ func (w *wavefront) SendMetric(name string, value float64, ts int64, source stri
 	}
 }
 
+// SendDeltaCounter sends a delta counter, aggregated by Wavefront across all sources reporting it
+func (w *wavefront) SendDeltaCounter(name string, value float64, source string, tags map[string]string) {
+	name, source, tags = w.sanitize(name, source, tags)
+	if trace {
+		line, err := senders.MetricLine(name, value, 0, source, tags, "")
+		if err != nil {
+			utils.Logger.Printf("[ERROR] error preparing the delta counter '%s': %v", name, err)
+		}
+		utils.Logger.Printf("[DEBUG] delta counter: %s", line)
+	}
+
+	if !w.filter.Match(name, tags) {
+		w.metricsFiltered.Inc(1)
+		return
+	}
+	tags, ok := w.limit(name, source, tags)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	err := w.sender.SendDeltaCounter(name, value, source, tags)
+	w.sentTimeMetric.Update(int64(time.Since(start)))
+
+	if err != nil {
+		w.metricsSendFailure.Inc(1)
+		if utils.Debug {
+			utils.Logger.Printf("[ERROR] error sending the delta counter '%s': %v", name, err)
+		}
+	} else {
+		w.numMetricsSent.Inc(1)
+	}
+}
+
+// SendDistribution sends a minute granularity distribution, histogram filters don't apply to it
+func (w *wavefront) SendDistribution(name string, centroids []histogram.Centroid, ts int64, source string, tags map[string]string) {
+	name, source, tags = w.sanitize(name, source, tags)
+	if trace {
+		line, err := senders.HistoLine(name, centroids, minuteGranularity, ts, source, tags, "")
+		if err != nil {
+			utils.Logger.Printf("[ERROR] error preparing the distribution '%s': %v", name, err)
+		}
+		utils.Logger.Printf("[DEBUG] distribution: %s", line)
+	}
+
+	if !w.filter.Match(name, tags) {
+		w.metricsFiltered.Inc(1)
+		return
+	}
+	tags, ok := w.limit(name, source, tags)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	err := w.sender.SendDistribution(name, centroids, minuteGranularity, ts, source, tags)
+	w.sentTimeMetric.Update(int64(time.Since(start)))
+
+	if err != nil {
+		w.metricsSendFailure.Inc(1)
+		if utils.Debug {
+			utils.Logger.Printf("[ERROR] error sending the distribution '%s': %v", name, err)
+		}
+	} else {
+		w.numMetricsSent.Inc(1)
+	}
+}
+
+// sanitize repairs the names, sources and tags Wavefront would reject, before the filters see them
+func (w *wavefront) sanitize(name, source string, tags map[string]string) (string, string, map[string]string) {
+	return w.sanitizer.Name(name), w.sanitizer.Source(source), w.sanitizer.Tags(tags)
+}
+
+// limit applies the cardinality budgets to the filtered points, the tags over budget are collapsed in a copy
+func (w *wavefront) limit(name, source string, tags map[string]string) (map[string]string, bool) {
+	if w.limiter == nil {
+		return tags, true
+	}
+	return w.limiter.Limit(name, source, tags)
+}
+
+// SendEvent sends an instantaneous event, ts is in milliseconds
+func (w *wavefront) SendEvent(name string, ts int64, source string, tags map[string]string, setters ...event.Option) {
+	source, tags = w.sanitizer.Source(source), w.sanitizer.Tags(tags)
+	if trace {
+		line, err := senders.EventLine(name, ts, 0, source, tags, setters...)
+		if err != nil {
+			utils.Logger.Printf("[ERROR] error preparing the event '%s': %v", name, err)
+		}
+		utils.Logger.Printf("[DEBUG] event: %s", line)
+	}
+
+	err := w.sender.SendEvent(name, ts, 0, source, tags, setters...)
+	if err != nil {
+		w.eventsSendFailure.Inc(1)
+		if utils.Debug {
+			utils.Logger.Printf("[ERROR] error sending the event '%s': %v", name, err)
+		}
+	} else {
+		w.numEventsSent.Inc(1)
+	}
+}
+
 func (w *wavefront) startHealthReport() {
 	ticker := time.NewTicker(time.Minute)
 	go func() {
-		for range ticker.C {
-			utils.Logger.Printf("total metrics sent: %d  filtered: %d  failures: %d", w.numMetricsSent.Count(), w.metricsFiltered.Count(), w.metricsSendFailure.Count())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				utils.Logger.Printf("total metrics sent: %d  filtered: %d  failures: %d", w.numMetricsSent.Count(), w.metricsFiltered.Count(), w.metricsSendFailure.Count())
+			case <-w.done:
+				return
+			}
 		}
 	}()
 }
@@ -166,3 +427,21 @@ func (w *wavefront) startHealthReport() {
 func (w *wavefront) ReportError(err error) {
 	w.handleErrorMetric.Inc(1)
 }
+
+// Close flushes the buffered data and closes the senders
+func (w *wavefront) Close() {
+	close(w.done)
+	if w.limiter != nil {
+		w.limiter.Close()
+	}
+
+	for _, sender := range []senders.Sender{w.sender, w.hisSender} {
+		if sender == nil {
+			continue
+		}
+		if err := sender.Flush(); err != nil {
+			utils.Logger.Printf("[ERROR] error flushing the Wavefront sender: %v", err)
+		}
+		sender.Close()
+	}
+}
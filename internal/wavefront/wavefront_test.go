@@ -0,0 +1,165 @@
+package wavefront
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/aggregation"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/cardinality"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/filter"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+)
+
+type point struct {
+	name   string
+	value  float64
+	ts     int64
+	source string
+	tags   map[string]string
+}
+
+// recordingWavefront keeps the metrics sent
+type recordingWavefront struct {
+	points []point
+	closed bool
+}
+
+func (r *recordingWavefront) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) {
+	r.points = append(r.points, point{name: name, value: value, ts: ts, source: source, tags: utils.CopyTags(tags)})
+}
+
+func (r *recordingWavefront) SendDeltaCounter(name string, value float64, source string, tags map[string]string) {
+}
+
+func (r *recordingWavefront) SendDistribution(name string, centroids []histogram.Centroid, ts int64, source string, tags map[string]string) {
+}
+
+func (r *recordingWavefront) SendEvent(name string, ts int64, source string, tags map[string]string, setters ...event.Option) {
+}
+
+func (r *recordingWavefront) ReportError(err error) {}
+
+func (r *recordingWavefront) Close() {
+	r.closed = true
+}
+
+func TestSharedSenders(t *testing.T) {
+	conf := &config.WavefrontConfig{DryRun: true, Filters: &filter.Filters{}}
+	tags := map[string]string{"foundation": "foo"}
+	first := NewWavefront(conf, tags)
+	second := NewWavefront(&config.WavefrontConfig{DryRun: true, Filters: &filter.Filters{}}, map[string]string{"foundation": "foo"})
+	assert.Same(t, first.(*sharedWavefront).Wavefront, second.(*sharedWavefront).Wavefront)
+	assert.Len(t, pools, 1)
+
+	// the internal metrics of another foundation have their own tags, but a single reporter
+	other := NewWavefront(conf, map[string]string{"foundation": "bar"})
+	assert.NotSame(t, first.(*sharedWavefront).Wavefront, other.(*sharedWavefront).Wavefront)
+	assert.Same(t, pools["dry-run|foundation=foo"], reporterPool)
+
+	// a handle is released once
+	first.Close()
+	first.Close()
+	assert.Equal(t, 1, pools["dry-run|foundation=foo"].refs)
+
+	second.Close()
+	assert.Same(t, pools["dry-run|foundation=bar"], reporterPool, "the reporter moves to the remaining client")
+	other.Close()
+	assert.Empty(t, pools)
+	assert.Nil(t, reporter)
+
+	third := NewWavefront(conf, tags)
+	assert.NotSame(t, first.(*sharedWavefront).Wavefront, third.(*sharedWavefront).Wavefront)
+	third.Close()
+}
+
+func TestDestination(t *testing.T) {
+	direct := &config.WavefrontConfig{URL: "https://wavefront.local", Token: "token", ProxyAddr: "proxy.local", ProxyPort: 2878}
+	proxy := &config.WavefrontConfig{ProxyAddr: "proxy.local", ProxyPort: 2878, ProxyHisToMinPort: 40001}
+	otherProxy := &config.WavefrontConfig{ProxyAddr: "proxy.local", ProxyPort: 2879, ProxyHisToMinPort: 40001}
+
+	assert.Equal(t, "dry-run", destination(&config.WavefrontConfig{DryRun: true, URL: "https://wavefront.local", Token: "token"}))
+	assert.NotEqual(t, destination(direct), destination(proxy))
+	assert.NotContains(t, destination(direct), "token", "the token is hashed")
+	assert.NotEqual(t, destination(direct), destination(&config.WavefrontConfig{URL: "https://wavefront.local", Token: "other"}))
+	assert.NotEqual(t, destination(proxy), destination(otherProxy))
+	assert.Equal(t, destination(proxy), destination(&config.WavefrontConfig{ProxyAddr: " proxy.local ", ProxyPort: 2878, ProxyHisToMinPort: 40001}))
+}
+
+func TestAggregator(t *testing.T) {
+	rules, err := aggregation.Parse([]string{"pcf.container.*=1h:min+max+count", "pcf.gorouter.*=1h"})
+	assert.Nil(t, err)
+
+	next := &recordingWavefront{}
+	assert.Same(t, next, newAggregator(next, nil, nil))
+
+	wf := newAggregator(next, rules, nil)
+	tags := map[string]string{"app": "foo"}
+	wf.SendMetric("pcf.container.rep.cpu_percentage", 10, 1, "cell-1", tags)
+	wf.SendMetric("pcf.container.rep.cpu_percentage", 30, 2, "cell-1", tags)
+	wf.SendMetric("pcf.container.rep.cpu_percentage", 5, 3, "cell-2", tags)
+	wf.SendMetric("pcf.gorouter.latency", 2, 1, "router", tags)
+	wf.SendMetric("pcf.gorouter.latency", 4, 2, "router", tags)
+
+	// the callers reuse the tags maps
+	tags["app"] = "bar"
+	wf.SendMetric("pcf.uaa.requests", 1, 1, "uaa", tags)
+
+	assert.Len(t, next.points, 1)
+	assert.Equal(t, "pcf.uaa.requests", next.points[0].name)
+	assert.Equal(t, int64(3), wf.(*aggregator).size())
+
+	wf.Close()
+	assert.True(t, next.closed)
+
+	sent := next.points[1:]
+	sort.Slice(sent, func(i, j int) bool {
+		if sent[i].name != sent[j].name {
+			return sent[i].name < sent[j].name
+		}
+		return sent[i].source < sent[j].source
+	})
+	assert.Equal(t, []point{
+		{name: "pcf.container.rep.cpu_percentage.count", value: 2, ts: 2, source: "cell-1", tags: map[string]string{"app": "foo"}},
+		{name: "pcf.container.rep.cpu_percentage.count", value: 1, ts: 3, source: "cell-2", tags: map[string]string{"app": "foo"}},
+		{name: "pcf.container.rep.cpu_percentage.max", value: 30, ts: 2, source: "cell-1", tags: map[string]string{"app": "foo"}},
+		{name: "pcf.container.rep.cpu_percentage.max", value: 5, ts: 3, source: "cell-2", tags: map[string]string{"app": "foo"}},
+		{name: "pcf.container.rep.cpu_percentage.min", value: 10, ts: 2, source: "cell-1", tags: map[string]string{"app": "foo"}},
+		{name: "pcf.container.rep.cpu_percentage.min", value: 5, ts: 3, source: "cell-2", tags: map[string]string{"app": "foo"}},
+		{name: "pcf.gorouter.latency", value: 3, ts: 2, source: "router", tags: map[string]string{"app": "foo"}},
+	}, sent)
+}
+
+func TestCardinalityLimiter(t *testing.T) {
+	budgets, err := cardinality.Parse(cardinality.Options{MaxSeries: 1, Policy: cardinality.Drop, Window: time.Hour})
+	assert.Nil(t, err)
+
+	wf := newWavefront(&config.WavefrontConfig{DryRun: true, Filters: &filter.Filters{}, Cardinality: budgets}, nil)
+	defer wf.Close()
+	assert.NotNil(t, wf.limiter)
+
+	sent := wf.numMetricsSent.Count()
+	wf.SendMetric("pcf.app.requests", 1, 0, "source", map[string]string{"request_id": "1"})
+	wf.SendMetric("pcf.app.requests", 1, 0, "source", map[string]string{"request_id": "2"})
+	wf.SendDeltaCounter("pcf.app.requests.delta", 1, "source", map[string]string{"request_id": "1"})
+	assert.Equal(t, sent+2, wf.numMetricsSent.Count())
+
+	assert.Nil(t, newWavefront(&config.WavefrontConfig{DryRun: true, Filters: &filter.Filters{}}, nil).limiter)
+}
+
+func TestSanitizedPoints(t *testing.T) {
+	wf := newWavefront(&config.WavefrontConfig{DryRun: true, Filters: &filter.Filters{}}, nil)
+	defer wf.Close()
+
+	sent, failures := wf.numMetricsSent.Count(), wf.metricsSendFailure.Count()
+	tags := map[string]string{"app": "foo", "empty": ""}
+	wf.SendMetric("pcf.app.requests", 1, 0, "source", tags)
+	wf.SendDeltaCounter("pcf.app.requests.delta", 1, "source", tags)
+	assert.Equal(t, sent+2, wf.numMetricsSent.Count())
+	assert.Equal(t, failures, wf.metricsSendFailure.Count())
+	assert.Contains(t, tags, "empty", "the caller tags are unchanged")
+}
@@ -0,0 +1,32 @@
+package legacy
+
+import (
+	"context"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/capture"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// newRecorder creates a capture file of the received envelopes
+func newRecorder(path string) (*capture.Recorder, error) {
+	return capture.NewRecorder(path, capture.KindV1, func(e interface{}) ([]byte, error) {
+		return e.(*events.Envelope).Marshal()
+	}, utils.GetInternalTags())
+}
+
+// replayFile feeds the envelopes of a capture file to the events channel
+func replayFile(ctx context.Context, path string, speed float64, eventsChannel chan *events.Envelope) error {
+	return capture.ReplayFile(ctx, path, capture.KindV1, speed, func(data []byte) error {
+		e := &events.Envelope{}
+		if err := e.Unmarshal(data); err != nil {
+			return err
+		}
+		select {
+		case eventsChannel <- e:
+			puts.Inc(1)
+		case <-ctx.Done():
+		}
+		return nil
+	})
+}
@@ -28,10 +28,9 @@ type EventHandler struct {
 
 // CreateEventHandler create a new EventHandler
 func CreateEventHandler(conf *config.WavefrontConfig) *EventHandler {
-	wf := wavefront.NewWavefront(conf)
-
 	internalTags := utils.GetInternalTags()
 	utils.Logger.Printf("internalTags: %v", internalTags)
+	wf := wavefront.NewWavefront(conf, internalTags)
 
 	numValueMetricReceived := utils.NewCounter("value-metric-received", internalTags)
 	numCounterEventReceived := utils.NewCounter("counter-event-received", internalTags)
@@ -155,3 +154,8 @@ func (w *EventHandler) getTags(event *events.Envelope) map[string]string {
 func (w *EventHandler) ReportError(err error) {
 	w.wf.ReportError(err)
 }
+
+// Close flushes and closes the Wavefront senders
+func (w *EventHandler) Close() {
+	w.wf.Close()
+}
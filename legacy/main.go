@@ -1,10 +1,11 @@
 package legacy
 
 import (
-	"crypto/tls"
+	"context"
 	"log"
 	"os"
 	"reflect"
+	"time"
 
 	"github.com/cloudfoundry/noaa/consumer"
 	noaaerrors "github.com/cloudfoundry/noaa/errors"
@@ -12,6 +13,8 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/rcrowley/go-metrics"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/api"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/backpressure"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/capture"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
 	"github.com/wavefronthq/go-metrics-wavefront/reporting"
@@ -24,33 +27,62 @@ var (
 	eventsChannel chan *events.Envelope
 	errorsChannel chan error
 	puts          = metrics.NewCounter()
+	drops         = metrics.NewCounter()
 )
 
-func Run(conf *config.Config) {
+// Run consumes the firehose until ctx is done, then drains the queue and stops the workers
+func Run(ctx context.Context, conf *config.Config) {
 	eventsChannel = make(chan *events.Envelope, conf.Nozzle.ChannelSize)
 	errorsChannel = make(chan error)
 
 	reporting.RegisterMetric("nozzle.queue.size", metrics.NewFunctionalGauge(queueSize), utils.GetInternalTags())
 	reporting.RegisterMetric("nozzle.queue.used", metrics.NewFunctionalGauge(queueUsed), utils.GetInternalTags())
 	reporting.RegisterMetric("nozzle.queue.puts", puts, utils.GetInternalTags())
+	reporting.RegisterMetric("nozzle.queue.drops", drops, utils.GetInternalTags())
+
+	name, timeout := queuePolicy(conf.Nozzle)
+	policy, err := backpressure.New(name, timeout, eventType, drops, conf.InternalTags())
+	if err != nil {
+		logger.Fatal("[ERROR] Invalid queue policy: ", err)
+	}
+	logger.Printf("Queue policy: %s", policy.Name())
+	queue := backpressure.NewChanQueue(eventsChannel)
 
 	var nozzles []*Nozzle
 	for i := 0; i < conf.Nozzle.Workers; i++ {
 		nozzles = append(nozzles, NewNozzle(conf, eventsChannel, errorsChannel))
 	}
 
-	for {
-		var trafficControllerURL string
-		logger.Printf("Fetching auth token via UAA: %v\n", conf.Nozzle.APIURL)
+	if len(conf.Nozzle.ReplayFile) > 0 {
+		logger.Printf("Replaying '%s' at %vx speed", conf.Nozzle.ReplayFile, conf.Nozzle.ReplaySpeed)
+		if err := replayFile(ctx, conf.Nozzle.ReplayFile, conf.Nozzle.ReplaySpeed, eventsChannel); err != nil {
+			logger.Printf("[ERROR] error replaying '%s': %v", conf.Nozzle.ReplayFile, err)
+		}
+		shutdown(nozzles, nil, conf.Nozzle.ShutdownTimeout)
+		return
+	}
 
-		api, err := api.NewAPIClient(conf.Nozzle)
+	var recorded *capture.Recorder
+	if len(conf.Nozzle.RecordFile) > 0 {
+		recorded, err = newRecorder(conf.Nozzle.RecordFile)
 		if err != nil {
-			logger.Fatal("[ERROR] Unable to build API client: ", err)
+			logger.Fatal("[ERROR] Unable to create the capture file: ", err)
 		}
+		logger.Printf("Recording envelopes to '%s'", conf.Nozzle.RecordFile)
+	}
 
-		for _, nozzle := range nozzles {
-			nozzle.APIClient = api
-		}
+	api, err := api.NewAPIClient(conf.Nozzle, conf.InternalTags())
+	if err != nil {
+		logger.Fatal("[ERROR] Unable to build API client: ", err)
+	}
+
+	for _, nozzle := range nozzles {
+		nozzle.APIClient = api
+	}
+
+	for {
+		var trafficControllerURL string
+		logger.Printf("Fetching auth token via UAA: %v\n", conf.Nozzle.APIURL)
 
 		token, err := api.FetchAuthToken()
 		if err != nil {
@@ -63,9 +95,8 @@ func Run(conf *config.Config) {
 		}
 
 		logger.Printf("Consuming firehose: %v\n", trafficControllerURL)
-		noaaConsumer := consumer.New(trafficControllerURL, &tls.Config{
-			InsecureSkipVerify: conf.Nozzle.SkipSSL,
-		}, nil)
+		noaaConsumer := consumer.New(trafficControllerURL, conf.Nozzle.TLS.Clone(), nil)
+		noaaConsumer.RefreshTokenFrom(api.TokenProvider())
 		events, errs := noaaConsumer.FirehoseWithoutReconnect(conf.Nozzle.FirehoseSubscriptionID, token)
 
 		done := make(chan struct{})
@@ -73,23 +104,50 @@ func Run(conf *config.Config) {
 			for {
 				select {
 				case event := <-events:
-					puts.Inc(1)
-					eventsChannel <- event
+					if recorded != nil {
+						recorded.Record(event)
+					}
+					if policy.Enqueue(queue, event) {
+						puts.Inc(1)
+					}
 				case err := <-errs:
 					printError(err)
 					errorsChannel <- err
 					close(done)
 					return
+				case <-ctx.Done():
+					close(done)
+					return
 				}
 			}
 		}()
 		<-done
 
 		noaaConsumer.Close()
+		if ctx.Err() != nil {
+			shutdown(nozzles, recorded, conf.Nozzle.ShutdownTimeout)
+			return
+		}
 		logger.Println("Reconnecting")
 	}
 }
 
+// shutdown waits for the workers to drain the queue, then stops them
+func shutdown(nozzles []*Nozzle, recorded *capture.Recorder, timeout time.Duration) {
+	if recorded != nil {
+		recorded.Close()
+	}
+
+	logger.Printf("Draining %d queued events", queueUsed())
+	if !utils.Drain(queueUsed, timeout) {
+		logger.Printf("[ERROR] Shutdown timeout expired, %d queued events lost", queueUsed())
+	}
+
+	for _, nozzle := range nozzles {
+		nozzle.Stop()
+	}
+}
+
 func queueSize() int64 {
 	return int64(cap(eventsChannel))
 }
@@ -110,3 +168,12 @@ func printError(err error) {
 		logger.Printf("Error from firehose - %v (%v)", err, reflect.TypeOf(err))
 	}
 }
+
+// queuePolicy returns the configured queue policy and block timeout, or block without timeout,
+// the firehose consumer always blocked on a full queue by default
+func queuePolicy(conf *config.NozzleConfig) (string, time.Duration) {
+	if len(conf.QueuePolicy) == 0 {
+		return backpressure.Block, 0
+	}
+	return conf.QueuePolicy, conf.QueueBlockTimeout
+}
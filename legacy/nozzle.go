@@ -15,6 +15,15 @@ var defaultEvents = []events.Envelope_EventType{
 	events.Envelope_ContainerMetric,
 }
 
+// v2Events maps the v2 envelope types to the legacy event types, so the same selected events work in both modes
+var v2Events = map[string][]events.Envelope_EventType{
+	"Counter": {events.Envelope_CounterEvent},
+	"Gauge":   {events.Envelope_ValueMetric, events.Envelope_ContainerMetric},
+	"Timer":   {events.Envelope_HttpStartStop},
+	"Event":   {events.Envelope_Error},
+	"Log":     {events.Envelope_LogMessage},
+}
+
 // Nozzle will read all CF events and sent it to the Forwarder
 type Nozzle struct {
 	eventsChannel chan *events.Envelope
@@ -24,6 +33,9 @@ type Nozzle struct {
 	eventSerializer    *EventHandler
 	includedEventTypes map[events.Envelope_EventType]bool
 	appsInfo           map[string]*api.AppInfo
+
+	done    chan struct{}
+	stopped chan struct{}
 }
 
 // NewNozzle create a new Nozzle
@@ -32,6 +44,8 @@ func NewNozzle(conf *config.Config, eventsChannel chan *events.Envelope, errorsC
 		eventSerializer: CreateEventHandler(conf.Wavefront),
 		eventsChannel:   eventsChannel,
 		errorsChannel:   errorsChannel,
+		done:            make(chan struct{}),
+		stopped:         make(chan struct{}),
 	}
 
 	nozzle.includedEventTypes = map[events.Envelope_EventType]bool{
@@ -51,13 +65,23 @@ func NewNozzle(conf *config.Config, eventsChannel chan *events.Envelope, errorsC
 	return nozzle
 }
 
+// Stop waits for the worker to finish the current event, then closes the Wavefront senders
+func (s *Nozzle) Stop() {
+	close(s.done)
+	<-s.stopped
+	s.eventSerializer.Close()
+}
+
 func (s *Nozzle) run() {
+	defer close(s.stopped)
 	for {
 		select {
 		case event := <-s.eventsChannel:
 			s.handleEvent(event)
 		case err := <-s.errorsChannel:
 			s.eventSerializer.ReportError(err)
+		case <-s.done:
+			return
 		}
 	}
 }
@@ -74,13 +98,12 @@ func (s *Nozzle) handleEvent(envelope *events.Envelope) {
 	case events.Envelope_CounterEvent:
 		s.eventSerializer.BuildCounterEvent(envelope)
 	case events.Envelope_ContainerMetric:
-		appGuIG := envelope.GetContainerMetric().GetApplicationId()
+		// there is no APIClient when replaying a capture file offline
+		var appInfo *api.AppInfo
 		if s.APIClient != nil {
-			appInfo := s.APIClient.GetApp(appGuIG)
-			s.eventSerializer.BuildContainerEvent(envelope, appInfo)
-		} else {
-			utils.Logger.Fatal("[ERROR] APIClient is null")
+			appInfo = s.APIClient.GetApp(envelope.GetContainerMetric().GetApplicationId())
 		}
+		s.eventSerializer.BuildContainerEvent(envelope, appInfo)
 	}
 }
 
@@ -100,6 +123,8 @@ func ParseSelectedEvents(orgEnvValue string) []events.Envelope_EventType {
 		val, found := events.Envelope_EventType_value[envValueSlitTrimmed]
 		if found {
 			selectedEvents = append(selectedEvents, events.Envelope_EventType(val))
+		} else if v1Events, found := v2Events[envValueSlitTrimmed]; found {
+			selectedEvents = append(selectedEvents, v1Events...)
 		} else {
 			utils.Logger.Panicf("[%s] is not a valid event type", orgEnvValue)
 		}
@@ -0,0 +1,12 @@
+package legacy
+
+import (
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// eventType returns the event type, used to break down the queue drops
+func eventType(item interface{}) string {
+	return strings.ToLower(item.(*events.Envelope).GetEventType().String())
+}
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/legacy"
@@ -13,10 +19,28 @@ func main() {
 		utils.Logger.Fatal("[ERROR] Unable to build config from environment: ", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		utils.Logger.Printf("Received %v, shutting down", sig)
+		cancel()
+	}()
+
 	if conf.Nozzle.AdvancedConfig.Values.LegacyMode {
 		utils.Logger.Println("Using deprecated v1 Cloud Foundry API")
-		legacy.Run(conf)
+		legacy.Run(ctx, conf)
 	} else {
-		nozzle.Run(conf)
+		var wg sync.WaitGroup
+		for _, foundationConf := range conf.PerFoundation() {
+			wg.Add(1)
+			go func(foundationConf *config.Config) {
+				defer wg.Done()
+				nozzle.Run(ctx, foundationConf)
+			}(foundationConf)
+		}
+		wg.Wait()
 	}
+	utils.Logger.Println("Nozzle stopped")
 }
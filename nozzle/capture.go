@@ -0,0 +1,33 @@
+package nozzle
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/capture"
+)
+
+// newRecorder creates a capture file of the received envelopes
+func newRecorder(path string, internalTags map[string]string) (*capture.Recorder, error) {
+	return capture.NewRecorder(path, capture.KindV2, func(e interface{}) ([]byte, error) {
+		return proto.Marshal(e.(*loggregator_v2.Envelope))
+	}, internalTags)
+}
+
+// replayFile feeds the envelopes of a capture file to the events channel
+func replayFile(ctx context.Context, path string, speed float64, events chan *loggregator_v2.Envelope, puts metrics.Counter) error {
+	return capture.ReplayFile(ctx, path, capture.KindV2, speed, func(data []byte) error {
+		e := &loggregator_v2.Envelope{}
+		if err := proto.Unmarshal(data, e); err != nil {
+			return err
+		}
+		select {
+		case events <- e:
+			puts.Inc(1)
+		case <-ctx.Done():
+		}
+		return nil
+	})
+}
@@ -0,0 +1,273 @@
+package nozzle
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/wavefront"
+	"github.com/wavefronthq/go-metrics-wavefront/reporting"
+)
+
+// counter modes, which of the '.total' and '.delta' metrics are sent
+const (
+	counterTotal = "total"
+	counterDelta = "delta"
+	counterBoth  = "both"
+)
+
+type counterMode struct {
+	pattern glob.Glob
+	mode    string
+}
+
+// rateSeries is the last total of a counter series
+type rateSeries struct {
+	total    uint64
+	ts       int64
+	lastSeen time.Time
+}
+
+// counterConverter decides the metrics sent for a counter, and keeps the last totals of the
+// counters converted to rates. It's shared by the workers.
+type counterConverter struct {
+	deltaCounters bool
+	modes         []counterMode
+	rates         []glob.Glob
+	expiration    time.Duration
+
+	mutex  sync.Mutex
+	series map[string]*rateSeries
+
+	resets  metrics.Counter
+	wraps   metrics.Counter
+	expired metrics.Counter
+
+	done chan struct{}
+}
+
+func newCounterConverter(conf *config.NozzleConfig, internalTags map[string]string) (*counterConverter, error) {
+	cc := &counterConverter{
+		deltaCounters: conf.DeltaCounters,
+		expiration:    conf.CounterRateExpiration,
+		series:        make(map[string]*rateSeries),
+		resets:        utils.NewCounter("nozzle.counters.resets", internalTags),
+		wraps:         utils.NewCounter("nozzle.counters.wraps", internalTags),
+		expired:       utils.NewCounter("nozzle.counters.expired", internalTags),
+		done:          make(chan struct{}),
+	}
+
+	for _, m := range conf.CounterModes {
+		if m = strings.TrimSpace(m); len(m) == 0 {
+			continue
+		}
+		pattern, mode, err := utils.SplitPair(m, "pattern=mode")
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter mode '%s': %v", m, err)
+		}
+		switch mode {
+		case counterTotal, counterDelta, counterBoth:
+		default:
+			return nil, fmt.Errorf("invalid counter mode '%s' (%s, %s or %s)", mode, counterTotal, counterDelta, counterBoth)
+		}
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter pattern '%s': %v", pattern, err)
+		}
+		cc.modes = append(cc.modes, counterMode{pattern: g, mode: mode})
+	}
+
+	for _, pattern := range conf.CounterRates {
+		if pattern = strings.TrimSpace(pattern); len(pattern) == 0 {
+			continue
+		}
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter rate pattern '%s': %v", pattern, err)
+		}
+		cc.rates = append(cc.rates, g)
+	}
+
+	reporting.RegisterMetric("nozzle.counters.series", metrics.NewFunctionalGauge(cc.size), internalTags)
+	return cc, nil
+}
+
+// start expires the idle rate series
+func (cc *counterConverter) start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cc.expire()
+			case <-cc.done:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the expiration
+func (cc *counterConverter) close() {
+	close(cc.done)
+}
+
+// mode returns the mode of the first pattern matching the counter name, both metrics by default
+func (cc *counterConverter) mode(name string) string {
+	for _, m := range cc.modes {
+		if m.pattern.Match(name) {
+			return m.mode
+		}
+	}
+	return counterBoth
+}
+
+// convertToRate returns true if a rate is computed for the counter name
+func (cc *counterConverter) convertToRate(name string) bool {
+	for _, pattern := range cc.rates {
+		if pattern.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// rate returns the per second rate of the series since its previous total, ts is in nanoseconds.
+// There is no rate for the first total of a series, or for a total older than the previous one.
+func (cc *counterConverter) rate(name, source string, tags map[string]string, total uint64, ts int64) (float64, bool) {
+	key := utils.SeriesKey(name, source, tags)
+
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	s, ok := cc.series[key]
+	if !ok {
+		cc.series[key] = &rateSeries{total: total, ts: ts, lastSeen: time.Now()}
+		return 0, false
+	}
+	s.lastSeen = time.Now()
+	if ts <= s.ts {
+		return 0, false
+	}
+
+	var increase uint64
+	switch {
+	case total >= s.total:
+		increase = total - s.total
+	case wrapped(s.total, total):
+		increase = math.MaxUint64 - s.total + total + 1
+		cc.wraps.Inc(1)
+	default:
+		// the emitter restarted, the counter starts over from zero
+		increase = total
+		cc.resets.Inc(1)
+	}
+
+	elapsed := float64(ts-s.ts) / float64(time.Second)
+	s.total = total
+	s.ts = ts
+	return float64(increase) / elapsed, true
+}
+
+// wrapped returns true if a total close to the uint64 max went back close to zero, any other decrease is a reset
+func wrapped(previous, current uint64) bool {
+	return previous > math.MaxUint64-math.MaxUint64/4 && current < math.MaxUint64/4
+}
+
+// expire removes the series without totals for longer than the expiration
+func (cc *counterConverter) expire() {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	for key, s := range cc.series {
+		if time.Since(s.lastSeen) > cc.expiration {
+			delete(cc.series, key)
+			cc.expired.Inc(1)
+		}
+	}
+}
+
+func (cc *counterConverter) size() int64 {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return int64(len(cc.series))
+}
+
+type deltaSeries struct {
+	name   string
+	source string
+	tags   map[string]string
+	value  float64
+}
+
+// deltaAggregator sums the counter deltas of a worker, and sends them as Wavefront delta counters every flush interval
+type deltaAggregator struct {
+	mutex  sync.Mutex
+	series map[string]*deltaSeries
+	wf     wavefront.Wavefront
+	done   chan struct{}
+}
+
+func newDeltaAggregator(wf wavefront.Wavefront) *deltaAggregator {
+	return &deltaAggregator{
+		series: make(map[string]*deltaSeries),
+		wf:     wf,
+		done:   make(chan struct{}),
+	}
+}
+
+func (da *deltaAggregator) start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				da.flush()
+			case <-da.done:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the periodic flushes and sends the pending deltas
+func (da *deltaAggregator) close() {
+	close(da.done)
+	da.flush()
+}
+
+// update adds the delta to the series, the tags are copied as the callers reuse them
+func (da *deltaAggregator) update(name string, value float64, source string, tags map[string]string) {
+	key := utils.SeriesKey(name, source, tags)
+
+	da.mutex.Lock()
+	defer da.mutex.Unlock()
+
+	s, ok := da.series[key]
+	if !ok {
+		s = &deltaSeries{name: name, source: source, tags: utils.CopyTags(tags)}
+		da.series[key] = s
+	}
+	s.value += value
+}
+
+func (da *deltaAggregator) flush() {
+	da.mutex.Lock()
+	series := da.series
+	da.series = make(map[string]*deltaSeries, len(series))
+	da.mutex.Unlock()
+
+	for _, s := range series {
+		if s.value != 0 {
+			da.wf.SendDeltaCounter(s.name, s.value, s.source, s.tags)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package nozzle
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/wavefront"
+)
+
+var logTypes = map[loggregator_v2.Log_Type]string{
+	loggregator_v2.Log_OUT: "stdout",
+	loggregator_v2.Log_ERR: "stderr",
+}
+
+type logCount struct {
+	tags  map[string]string
+	lines int64
+	bytes int64
+}
+
+// logAggregator counts log lines and bytes per app, log type and source type, and reports them as delta counters
+type logAggregator struct {
+	mutex  sync.Mutex
+	counts map[string]*logCount
+	prefix string
+	wf     wavefront.Wavefront
+	done   chan struct{}
+}
+
+func newLogAggregator(prefix string, wf wavefront.Wavefront) *logAggregator {
+	return &logAggregator{
+		counts: make(map[string]*logCount),
+		prefix: prefix,
+		wf:     wf,
+		done:   make(chan struct{}),
+	}
+}
+
+func (la *logAggregator) start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				la.flush()
+			case <-la.done:
+				return
+			}
+		}
+	}()
+}
+
+// close stops the periodic flushes and sends the current counts
+func (la *logAggregator) close() {
+	close(la.done)
+	la.flush()
+}
+
+func (la *logAggregator) update(sourceID string, log *loggregator_v2.Log, sourceType string, tags func() map[string]string) {
+	logType := logTypes[log.GetType()]
+	key := sourceID + "|" + logType + "|" + sourceType
+
+	la.mutex.Lock()
+	defer la.mutex.Unlock()
+
+	c, ok := la.counts[key]
+	if !ok {
+		t := tags()
+		t["log_type"] = logType
+		if len(sourceType) > 0 {
+			t["source_type"] = sourceType
+		}
+		c = &logCount{tags: t}
+		la.counts[key] = c
+	}
+	c.lines++
+	c.bytes += int64(len(log.GetPayload()))
+}
+
+func (la *logAggregator) flush() {
+	la.mutex.Lock()
+	counts := la.counts
+	la.counts = make(map[string]*logCount, len(counts))
+	la.mutex.Unlock()
+
+	for _, c := range counts {
+		la.wf.SendDeltaCounter(la.prefix+".logs.lines", float64(c.lines), "", c.tags)
+		la.wf.SendDeltaCounter(la.prefix+".logs.bytes", float64(c.bytes), "", c.tags)
+	}
+}
+
+// logSourceType returns the component that emitted the log, 'APP/PROC/WEB/0' => 'APP'
+func logSourceType(event *loggregator_v2.Envelope) string {
+	sourceType := event.GetTags()["source_type"]
+	if i := strings.Index(sourceType, "/"); i >= 0 {
+		sourceType = sourceType[:i]
+	}
+	return sourceType
+}
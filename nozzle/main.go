@@ -2,132 +2,377 @@ package nozzle
 
 import (
 	"context"
-	"crypto/tls"
-	"net/http"
+	"fmt"
+	"strings"
+	"time"
 
-	loggregator "code.cloudfoundry.org/go-loggregator/v8"
 	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
-	"github.com/rcrowley/go-metrics"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/api"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/backpressure"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/capture"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
-	"github.com/wavefronthq/go-metrics-wavefront/reporting"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/wavefront"
 )
 
-var allSelectors = []*loggregator_v2.Selector{
-	{
-		Message: &loggregator_v2.Selector_Counter{
-			Counter: &loggregator_v2.CounterSelector{},
-		},
+var counterSelector = &loggregator_v2.Selector{
+	Message: &loggregator_v2.Selector_Counter{
+		Counter: &loggregator_v2.CounterSelector{},
 	},
-	{
-		Message: &loggregator_v2.Selector_Gauge{
-			Gauge: &loggregator_v2.GaugeSelector{},
-		},
+}
+
+var gaugeSelector = &loggregator_v2.Selector{
+	Message: &loggregator_v2.Selector_Gauge{
+		Gauge: &loggregator_v2.GaugeSelector{},
 	},
 }
 
-var (
-	eventsChannel chan *loggregator_v2.Envelope
-	errorsChannel chan error
-	puts          = metrics.NewCounter()
-	drops         = metrics.NewCounter()
-)
+var timerSelector = &loggregator_v2.Selector{
+	Message: &loggregator_v2.Selector_Timer{
+		Timer: &loggregator_v2.TimerSelector{},
+	},
+}
+
+var eventSelector = &loggregator_v2.Selector{
+	Message: &loggregator_v2.Selector_Event{
+		Event: &loggregator_v2.EventSelector{},
+	},
+}
+
+var logSelector = &loggregator_v2.Selector{
+	Message: &loggregator_v2.Selector_Log{
+		Log: &loggregator_v2.LogSelector{},
+	},
+}
+
+var defaultSelectors = []*loggregator_v2.Selector{counterSelector, gaugeSelector}
 
-func Run(conf *config.Config) {
-	eventsChannel = make(chan *loggregator_v2.Envelope, conf.Nozzle.ChannelSize)
-	errorsChannel = make(chan error)
+// eventSelectors maps the v2 envelope types, and the legacy v1 event types, to RLP selectors
+var eventSelectors = map[string]*loggregator_v2.Selector{
+	"Counter": counterSelector,
+	"Gauge":   gaugeSelector,
+	"Timer":   timerSelector,
+	"Event":   eventSelector,
+	"Log":     logSelector,
 
-	reporting.RegisterMetric("nozzle.queue.size", metrics.NewFunctionalGauge(queueSize), utils.GetInternalTags())
-	reporting.RegisterMetric("nozzle.queue.used", metrics.NewFunctionalGauge(queueUsed), utils.GetInternalTags())
-	reporting.RegisterMetric("nozzle.queue.puts", puts, utils.GetInternalTags())
-	reporting.RegisterMetric("nozzle.queue.drops", drops, utils.GetInternalTags())
+	"CounterEvent":    counterSelector,
+	"ValueMetric":     gaugeSelector,
+	"ContainerMetric": gaugeSelector,
+	"HttpStartStop":   timerSelector,
+	"Error":           eventSelector,
+	"LogMessage":      logSelector,
+}
+
+// Run consumes the RLP stream of a foundation until ctx is done, then drains the queue and stops the workers.
+// Every foundation has its own queue, workers and API client.
+func Run(ctx context.Context, conf *config.Config) {
+	selectors, err := buildSelectors(conf.Nozzle)
+	if err != nil {
+		utils.Logger.Fatal("[ERROR] Invalid selected events: ", err)
+	}
+
+	internalTags := conf.InternalTags()
+	eventsChannel := make(chan *loggregator_v2.Envelope, conf.Nozzle.ChannelSize)
+	queue := newEnvelopeQueue(eventsChannel, internalTags)
+	puts := utils.NewCounter("nozzle.queue.puts", internalTags)
+	drops := utils.NewCounter("nozzle.queue.drops", internalTags)
+	reconnects := newReconnectCounters(internalTags)
+
+	counters, err := newCounterConverter(conf.Nozzle, internalTags)
+	if err != nil {
+		utils.Logger.Fatal("[ERROR] Invalid counters configuration: ", err)
+	}
+	counters.start(time.Minute)
+
+	timers := newTimerAggregator(wavefront.NewWavefront(conf.Wavefront, internalTags))
+	timers.start(time.Minute)
+
+	var rollups *appRollups
+	if conf.Nozzle.EnableAppRollups {
+		rollups = newAppRollups(conf, internalTags)
+		rollups.start(conf.Nozzle.AppRollupsInterval)
+	}
 
 	var nozzles []*Nozzle
 	for i := 0; i < conf.Nozzle.Workers; i++ {
-		nozzles = append(nozzles, NewNozzle(conf, eventsChannel))
+		nozzles = append(nozzles, NewNozzle(conf, eventsChannel, timers, counters, rollups))
 	}
 
-	for {
-		api, err := api.NewAPIClient(conf.Nozzle)
+	policy, err := backpressure.New(queuePolicy(conf.Nozzle), conf.Nozzle.QueueBlockTimeout, envelopeType, drops, internalTags)
+	if err != nil {
+		utils.Logger.Fatal("[ERROR] Invalid queue policy: ", err)
+	}
+	utils.Logger.Printf("Queue policy: %s", policy.Name())
+
+	if len(conf.Nozzle.ReplayFile) > 0 {
+		utils.Logger.Printf("Replaying '%s' at %vx speed", conf.Nozzle.ReplayFile, conf.Nozzle.ReplaySpeed)
+		if err := replayFile(ctx, conf.Nozzle.ReplayFile, conf.Nozzle.ReplaySpeed, eventsChannel, puts); err != nil {
+			utils.Logger.Printf("[ERROR] error replaying '%s': %v", conf.Nozzle.ReplayFile, err)
+		}
+		shutdown(nozzles, timers, counters, rollups, queue, nil, nil, conf.Nozzle.ShutdownTimeout)
+		return
+	}
+
+	var recorded *capture.Recorder
+	if len(conf.Nozzle.RecordFile) > 0 {
+		recorded, err = newRecorder(conf.Nozzle.RecordFile, internalTags)
 		if err != nil {
-			utils.Logger.Fatal("[ERROR] Unable to build API client: ", err)
+			utils.Logger.Fatal("[ERROR] Unable to create the capture file: ", err)
 		}
+		utils.Logger.Printf("Recording envelopes to '%s'", conf.Nozzle.RecordFile)
+	}
 
-		for _, nozzle := range nozzles {
-			nozzle.Api = api
+	var spilled *spillBuffer
+	replayed := make(chan struct{})
+	if len(conf.Nozzle.SpillDir) > 0 {
+		spilled, err = newSpillBuffer(conf.Nozzle, internalTags)
+		if err != nil {
+			utils.Logger.Fatal("[ERROR] Unable to open the spill buffer: ", err)
 		}
+		utils.Logger.Printf("Spilling queue overflow to '%s'", conf.Nozzle.SpillDir)
+		policy.SetOverflow(func(item interface{}) bool {
+			return spilled.push(item.(*loggregator_v2.Envelope))
+		})
+		go func() {
+			defer close(replayed)
+			spilled.replay(ctx, eventsChannel)
+		}()
+	} else {
+		close(replayed)
+	}
 
-		ctx, cancel := context.WithCancel(context.Background())
+	api, err := api.NewAPIClient(conf.Nozzle, internalTags)
+	if err != nil {
+		utils.Logger.Fatal("[ERROR] Unable to build API client: ", err)
+	}
+
+	for _, nozzle := range nozzles {
+		nozzle.Api = api
+	}
+
+	connect, err := newStreamConnector(conf.Nozzle, api.TokenProvider(), internalTags)
+	if err != nil {
+		utils.Logger.Fatal("[ERROR] Invalid RLP configuration: ", err)
+	}
+
+	sourceIDs, err := resolveSourceIDs(conf.Nozzle, api)
+	if err != nil {
+		utils.Logger.Fatal("[ERROR] Unable to resolve source ids: ", err)
+	}
 
-		c := loggregator.NewRLPGatewayClient(
-			conf.Nozzle.LogStreamURL,
-			loggregator.WithRLPGatewayClientLogger(utils.Logger),
-			loggregator.WithRLPGatewayHTTPClient(&tokenAttacher{
-				api:    api,
-				cancel: cancel,
-			}),
-		)
+	bo := &backoff{min: conf.Nozzle.ReconnectMinBackoff, max: conf.Nozzle.ReconnectMaxBackoff}
+	for {
+		conn := newConnection()
 
-		es := c.Stream(ctx, &loggregator_v2.EgressBatchRequest{
-			Selectors: allSelectors,
+		es := connect(conn, &loggregator_v2.EgressBatchRequest{
+			Selectors: scopeSelectors(selectors, sourceIDs),
 			ShardId:   conf.Nozzle.FirehoseSubscriptionID,
 		})
 
+		produced := make(chan struct{})
 		go func() {
+			defer close(produced)
 			for {
-				for _, e := range es() {
-					select {
-					case eventsChannel <- e:
+				batch := es()
+				if batch == nil && conn.ctx.Err() == nil {
+					conn.close(reasonStreamClosed)
+				}
+				for _, e := range batch {
+					conn.touch()
+					if recorded != nil {
+						recorded.Record(e)
+					}
+					if policy.Enqueue(queue, e) {
 						puts.Inc(1)
-					default:
-						drops.Inc(1)
 					}
 				}
-				if ctx.Err() != nil {
+				if conn.ctx.Err() != nil {
 					return
 				}
 			}
 		}()
+		// syslog drains are quiet when the apps are, that's not a stall
+		if conf.Nozzle.RLPTransport != transportSyslog {
+			go conn.watch(conf.Nozzle.StreamStallTimeout)
+		}
+
+		connected := time.Now()
+		select {
+		case <-conn.ctx.Done():
+		case <-ctx.Done():
+			conn.close(reasonShutdown)
+			<-produced
+			<-replayed
+			shutdown(nozzles, timers, counters, rollups, queue, spilled, recorded, conf.Nozzle.ShutdownTimeout)
+			return
+		}
+		<-produced
+		reconnects[conn.reason].Inc(1)
+
+		// a connection that lived longer than the max backoff is considered healthy
+		if time.Since(connected) > conf.Nozzle.ReconnectMaxBackoff {
+			bo.reset()
+		}
+		if conf.Nozzle.ReconnectMaxRetries > 0 && bo.attempts >= conf.Nozzle.ReconnectMaxRetries {
+			utils.Logger.Fatalf("[ERROR] Stream closed (%s), giving up after %d reconnection attempts", conn.reason, bo.attempts)
+		}
+		delay := bo.next()
+		utils.Logger.Printf("Stream closed (%s), reconnecting in %v", conn.reason, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			<-replayed
+			shutdown(nozzles, timers, counters, rollups, queue, spilled, recorded, conf.Nozzle.ShutdownTimeout)
+			return
+		}
+		sourceIDs = refreshSourceIDs(conf.Nozzle, api, sourceIDs)
+	}
+}
 
-		<-ctx.Done()
+// refreshSourceIDs resolves the app names again before a reconnection, the current source ids are kept
+// when the API is unavailable so a CAPI outage doesn't stop the stream
+func refreshSourceIDs(conf *config.NozzleConfig, client api.Client, current []string) []string {
+	if len(conf.AppNames) == 0 {
+		return current
+	}
+	sourceIDs, err := resolveSourceIDs(conf, client)
+	if err != nil {
+		utils.Logger.Printf("[ERROR] Unable to resolve source ids, keeping %v: %v", current, err)
+		return current
 	}
+	return sourceIDs
 }
 
-func queueSize() int64 {
-	return int64(cap(eventsChannel))
+// shutdown waits for the workers to drain the queue, then stops them, spilled envelopes are kept on disk
+func shutdown(nozzles []*Nozzle, timers *timerAggregator, counters *counterConverter, rollups *appRollups, queue *backpressure.ChanQueue, spilled *spillBuffer, recorded *capture.Recorder, timeout time.Duration) {
+	if spilled != nil {
+		spilled.close()
+	}
+	if recorded != nil {
+		recorded.Close()
+	}
+
+	utils.Logger.Printf("Draining %d queued envelopes", queue.Used())
+	if !utils.Drain(queue.Used, timeout) {
+		utils.Logger.Printf("[ERROR] Shutdown timeout expired, %d queued envelopes lost", queue.Used())
+	}
+
+	for _, nozzle := range nozzles {
+		nozzle.Stop()
+	}
+	timers.close()
+	timers.wf.Close()
+	counters.close()
+	if rollups != nil {
+		rollups.close()
+	}
 }
 
-func queueUsed() int64 {
-	return int64(len(eventsChannel))
+func buildSelectors(conf *config.NozzleConfig) ([]*loggregator_v2.Selector, error) {
+	selectors, err := ParseSelectedEvents(conf.SelectedEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.EnableTimers {
+		selectors = appendSelector(selectors, timerSelector)
+	}
+	if conf.EnableEvents {
+		selectors = appendSelector(selectors, eventSelector)
+	}
+	if conf.EnableLogs || len(conf.LogRules) > 0 {
+		selectors = appendSelector(selectors, logSelector)
+	}
+	return selectors, nil
 }
 
-type tokenAttacher struct {
-	api    *api.APIClient
-	cancel context.CancelFunc
+// ParseSelectedEvents maps a list of v2 (Counter, Gauge...) or legacy (ValueMetric, CounterEvent...) event names to RLP selectors
+func ParseSelectedEvents(orgEnvValue string) ([]*loggregator_v2.Selector, error) {
+	envValue := strings.Trim(orgEnvValue, "[]")
+	if strings.TrimSpace(envValue) == "" {
+		return append([]*loggregator_v2.Selector{}, defaultSelectors...), nil
+	}
+
+	var selectors []*loggregator_v2.Selector
+	sep := " "
+	if strings.Contains(envValue, ",") {
+		sep = ","
+	}
+	for _, envValueSplit := range strings.Split(envValue, sep) {
+		name := strings.TrimSpace(envValueSplit)
+		if len(name) == 0 {
+			continue
+		}
+		selector, found := eventSelectors[name]
+		if !found {
+			return nil, fmt.Errorf("[%s] is not a valid event type", name)
+		}
+		selectors = appendSelector(selectors, selector)
+	}
+	return selectors, nil
 }
 
-func (a *tokenAttacher) Do(req *http.Request) (*http.Response, error) {
-	config := &tls.Config{
-		InsecureSkipVerify: true,
+// resolveSourceIDs returns the configured source ids plus the guids of the configured app names
+func resolveSourceIDs(conf *config.NozzleConfig, client api.Client) ([]string, error) {
+	var sourceIDs []string
+	for _, sourceID := range conf.SourceIDs {
+		if sourceID = strings.TrimSpace(sourceID); len(sourceID) > 0 {
+			sourceIDs = append(sourceIDs, sourceID)
+		}
 	}
-	tr := &http.Transport{TLSClientConfig: config}
-	client := &http.Client{Transport: tr}
 
-	if utils.Debug {
-		utils.Logger.Printf("Getting token")
+	var appNames []string
+	for _, appName := range conf.AppNames {
+		if appName = strings.TrimSpace(appName); len(appName) > 0 {
+			appNames = append(appNames, appName)
+		}
+	}
+	if len(appNames) == 0 {
+		return sourceIDs, nil
 	}
-	token, err := a.api.FetchAuthToken()
+
+	guids, err := client.AppGuidsByName(appNames)
 	if err != nil {
-		a.cancel()
 		return nil, err
 	}
+	if len(guids) == 0 {
+		return nil, fmt.Errorf("no apps found with names %v", appNames)
+	}
+	utils.Logger.Printf("Apps %v resolved to source ids %v", appNames, guids)
+	return append(sourceIDs, guids...), nil
+}
 
-	req.Header.Set("Authorization", token)
+// scopeSelectors replicates the selectors for each source id, no source ids means the whole firehose
+func scopeSelectors(selectors []*loggregator_v2.Selector, sourceIDs []string) []*loggregator_v2.Selector {
+	if len(sourceIDs) == 0 {
+		return selectors
+	}
 
-	res, err := client.Do(req)
-	if err != nil {
-		a.cancel()
+	scoped := make([]*loggregator_v2.Selector, 0, len(selectors)*len(sourceIDs))
+	for _, sourceID := range sourceIDs {
+		for _, selector := range selectors {
+			scoped = append(scoped, &loggregator_v2.Selector{
+				SourceId: sourceID,
+				Message:  selector.Message,
+			})
+		}
+	}
+	return scoped
+}
+
+func appendSelector(selectors []*loggregator_v2.Selector, selector *loggregator_v2.Selector) []*loggregator_v2.Selector {
+	for _, s := range selectors {
+		if s == selector {
+			return selectors
+		}
+	}
+	return append(selectors, selector)
+}
+
+// queuePolicy returns the configured queue policy, or drop-newest by default
+func queuePolicy(conf *config.NozzleConfig) string {
+	if len(conf.QueuePolicy) == 0 {
+		return backpressure.DropNewest
 	}
-	return res, err
+	return conf.QueuePolicy
 }
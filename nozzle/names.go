@@ -0,0 +1,55 @@
+package nozzle
+
+import "github.com/wavefronthq/cloud-foundry-nozzle-go/internal/naming"
+
+// maxCachedNames bounds the names cache of a worker, the cache starts over when it's full
+const maxCachedNames = 10000
+
+// nameKey holds the naming rule and the envelope values a metric name is built from
+type nameKey struct {
+	rule   *naming.Rule
+	suffix string
+	origin string
+	name   string
+	unit   string
+}
+
+// metricNames caches the metric names of a worker, so they are built once instead of for every envelope.
+// It's not safe for concurrent use.
+type metricNames struct {
+	prefix string
+	rules  *naming.Rules
+	names  map[nameKey]string
+}
+
+func newMetricNames(prefix string, rules *naming.Rules) *metricNames {
+	if rules == nil {
+		rules = naming.Default()
+	}
+	return &metricNames{
+		prefix: prefix,
+		rules:  rules,
+		names:  make(map[nameKey]string),
+	}
+}
+
+// get returns the metric name built by the first matching naming rule followed by 'suffix'.
+// Names of rules using tags depend on every tag value, they are built each time.
+func (mn *metricNames) get(kind, suffix, origin, name, unit string, tags map[string]string) string {
+	rule := mn.rules.Match(kind, origin, name, unit, tags)
+	if rule.UsesTags() {
+		return mn.rules.Name(rule, mn.prefix, origin, name, unit, tags) + suffix
+	}
+
+	key := nameKey{rule: rule, suffix: suffix, origin: origin, name: name, unit: unit}
+	if metricName, ok := mn.names[key]; ok {
+		return metricName
+	}
+
+	metricName := mn.rules.Name(rule, mn.prefix, origin, name, unit, tags) + suffix
+	if len(mn.names) >= maxCachedNames {
+		mn.names = make(map[nameKey]string)
+	}
+	mn.names[key] = metricName
+	return metricName
+}
@@ -1,15 +1,21 @@
 package nozzle
 
 import (
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
 	"github.com/rcrowley/go-metrics"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/api"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/derived"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/logrules"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/naming"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/wavefront"
+	"github.com/wavefronthq/wavefront-sdk-go/event"
 )
 
 // Nozzle will read all CF events and sent it to the Forwarder
@@ -21,53 +27,117 @@ type Nozzle struct {
 
 	numGaugeMetricReceived  metrics.Counter
 	numCounterEventReceived metrics.Counter
+	numTimerEventReceived   metrics.Counter
+	numEventReceived        metrics.Counter
+	numLogReceived          metrics.Counter
 
-	done chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+
+	// names and tags are reused for every envelope, only the worker goroutine touches them
+	names *metricNames
+	tags  map[string]string
 
 	wf                  wavefront.Wavefront
+	timers              *timerAggregator
+	deltas              *deltaAggregator
+	counters            *counterConverter
+	rollups             *appRollups
+	logs                *logAggregator
+	logRules            logrules.Rules
+	formulas            derived.Formulas
+	enableLogMetrics    bool
 	Api                 api.Client
 	enableAppTagLookups bool
 }
 
-var translateStrs = map[string]string{
-	"pcf.container.rep.cpu.percentage":     "pcf.container.rep.cpu_percentage",
-	"pcf.container.rep.disk.bytes":         "pcf.container.rep.disk_bytes",
-	"pcf.container.rep.disk_quota.bytes":   "pcf.container.rep.disk_bytes_quota",
-	"pcf.container.rep.memory.bytes":       "pcf.container.rep.memory_bytes",
-	"pcf.container.rep.memory_quota.bytes": "pcf.container.rep.memory_bytes_quota",
-}
+// timerTags are the envelope tags kept on timer distributions, the rest (request_id, user_agent...) have unbounded cardinality
+var timerTags = []string{"deployment", "job", "origin", "method", "status_code", "peer_type"}
 
 var trace = os.Getenv("WAVEFRONT_TRACE") == "true"
 
-// NewNozzle create a new Nozzle
-func NewNozzle(conf *config.Config, eventsChannel chan *loggregator_v2.Envelope) *Nozzle {
-	internalTags := utils.GetInternalTags()
+// hostname is the source of the envelopes without 'ip' and 'job' tags
+var hostname = getHostname()
+
+// NewNozzle create a new Nozzle, the timer distributions, the counters state and the app rollups (nil when disabled) are shared by the workers
+func NewNozzle(conf *config.Config, eventsChannel chan *loggregator_v2.Envelope, timers *timerAggregator, counters *counterConverter, rollups *appRollups) *Nozzle {
+	internalTags := conf.InternalTags()
 	utils.Logger.Printf("internalTags: %v", internalTags)
 
 	numGaugeMetricReceived := utils.NewCounter("gauge-metric-received", internalTags)
 	numCounterEventReceived := utils.NewCounter("counter-event-received", internalTags)
+	numTimerEventReceived := utils.NewCounter("timer-event-received", internalTags)
+	numEventReceived := utils.NewCounter("event-received", internalTags)
+	numLogReceived := utils.NewCounter("log-received", internalTags)
 
+	prefix := strings.Trim(conf.Wavefront.Prefix, " ")
+	wf := wavefront.NewWavefront(conf.Wavefront, internalTags)
 	nozzle := &Nozzle{
-		wf:                  wavefront.NewWavefront(conf.Wavefront),
+		wf:                  wf,
+		timers:              timers,
+		deltas:              newDeltaAggregator(wf),
+		counters:            counters,
+		rollups:             rollups,
+		logs:                newLogAggregator(prefix, wf),
 		enableAppTagLookups: conf.Nozzle.EnableAppCache,
+		logRules:            conf.Nozzle.LogRules,
+		formulas:            conf.Nozzle.DerivedMetrics,
+		enableLogMetrics:    logMetricsEnabled(conf.Nozzle),
 		eventsChannel:       eventsChannel,
+		done:                make(chan struct{}),
+		stopped:             make(chan struct{}),
+		names:               newMetricNames(prefix, conf.Nozzle.NamingRules),
+		tags:                make(map[string]string),
 
 		numGaugeMetricReceived:  numGaugeMetricReceived,
 		numCounterEventReceived: numCounterEventReceived,
+		numTimerEventReceived:   numTimerEventReceived,
+		numEventReceived:        numEventReceived,
+		numLogReceived:          numLogReceived,
 
-		prefix:     strings.Trim(conf.Wavefront.Prefix, " "),
+		prefix:     prefix,
 		foundation: strings.Trim(conf.Wavefront.Foundation, " "),
 	}
 
+	nozzle.deltas.start(time.Duration(conf.Wavefront.FlushInterval) * time.Second)
+	nozzle.logs.start(conf.Nozzle.LogMetricsInterval)
 	go nozzle.run()
 	return nozzle
 }
 
+// logMetricsEnabled returns true when the log lines are counted. The logs are streamed when NOZZLE_ENABLE_LOGS is set,
+// when 'Log' is a selected event, or to apply the extraction rules: the lines are counted in the first two cases,
+// but not when the logs are only streamed for the rules.
+func logMetricsEnabled(conf *config.NozzleConfig) bool {
+	return conf.EnableLogs || selectsLog(conf) || len(conf.LogRules) == 0
+}
+
+// selectsLog returns true when 'Log' is a selected event
+func selectsLog(conf *config.NozzleConfig) bool {
+	selectors, err := ParseSelectedEvents(conf.SelectedEvents)
+	if err != nil {
+		return false
+	}
+	for _, selector := range selectors {
+		if selector == logSelector {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop waits for the worker to finish the current event, then flushes the aggregated metrics and closes the Wavefront senders
 func (nozzle *Nozzle) Stop() {
 	close(nozzle.done)
+	<-nozzle.stopped
+
+	nozzle.deltas.close()
+	nozzle.logs.close()
+	nozzle.wf.Close()
 }
 
 func (nozzle *Nozzle) run() {
+	defer close(nozzle.stopped)
 	for {
 		select {
 		case event := <-nozzle.eventsChannel:
@@ -84,6 +154,12 @@ func (nozzle *Nozzle) handleEvent(envelope *loggregator_v2.Envelope) {
 		nozzle.BuildCounterEvent(envelope)
 	case *loggregator_v2.Envelope_Gauge:
 		nozzle.BuildGaugeEvent(envelope)
+	case *loggregator_v2.Envelope_Timer:
+		nozzle.BuildTimerEvent(envelope)
+	case *loggregator_v2.Envelope_Event:
+		nozzle.BuildEvent(envelope)
+	case *loggregator_v2.Envelope_Log:
+		nozzle.BuildLogEvent(envelope)
 	default:
 		// utils.Logger.Printf("---> %v\n", envelope)
 		// utils.Logger.Printf("---> %v\n", envelope.GetMessage())
@@ -95,52 +171,134 @@ func (nozzle *Nozzle) handleEvent(envelope *loggregator_v2.Envelope) {
 func (nozzle *Nozzle) BuildCounterEvent(event *loggregator_v2.Envelope) {
 	nozzle.numCounterEventReceived.Inc(1)
 
-	metricName := nozzle.prefix
-	if len(event.GetTags()["origin"]) > 0 {
-		metricName += "." + event.GetTags()["origin"]
-	}
-	metricName += "." + event.GetCounter().GetName()
-
+	origin := event.GetTags()["origin"]
+	name := event.GetCounter().GetName()
 	source, tags, ts := nozzle.getMetricInfo(event)
 
 	total := event.GetCounter().GetTotal()
 	delta := event.GetCounter().GetDelta()
 
-	nozzle.wf.SendMetric(metricName+".total", float64(total), ts, source, tags)
-	nozzle.wf.SendMetric(metricName+".delta", float64(delta), ts, source, tags)
+	mode, deltaCounters, toRate := counterBoth, false, false
+	if nozzle.counters != nil {
+		baseName := nozzle.metricName(naming.Counter, "", origin, name, "", event)
+		mode = nozzle.counters.mode(baseName)
+		deltaCounters = nozzle.counters.deltaCounters
+		toRate = nozzle.counters.convertToRate(baseName)
+	}
+
+	if mode != counterDelta {
+		nozzle.wf.SendMetric(nozzle.metricName(naming.Counter, ".total", origin, name, "", event), float64(total), ts, source, tags)
+	}
+	if mode != counterTotal {
+		deltaName := nozzle.metricName(naming.Counter, ".delta", origin, name, "", event)
+		if deltaCounters {
+			nozzle.deltas.update(deltaName, float64(delta), source, tags)
+		} else {
+			nozzle.wf.SendMetric(deltaName, float64(delta), ts, source, tags)
+		}
+	}
+	if toRate {
+		rateName := nozzle.metricName(naming.Counter, ".rate", origin, name, "", event)
+		if rate, ok := nozzle.counters.rate(rateName, source, tags, total, ts); ok {
+			nozzle.wf.SendMetric(rateName, rate, ts, source, tags)
+		}
+	}
 }
 
 func (nozzle *Nozzle) BuildGaugeEvent(event *loggregator_v2.Envelope) {
 	nozzle.numGaugeMetricReceived.Inc(1)
 
+	origin := event.GetTags()["origin"]
+	source, tags, ts := nozzle.getMetricInfo(event)
+
 	for name, metric := range event.GetGauge().GetMetrics() {
-		translate := false
-		metricName := nozzle.prefix
-		if _, ok := event.GetTags()["source_id"]; ok {
-			metricName += ".container"
-			translate = true
-		}
+		metricName := nozzle.metricName(naming.Gauge, "", origin, name, metric.GetUnit(), event)
+		nozzle.wf.SendMetric(metricName, metric.Value, ts, source, tags)
+	}
 
-		if len(event.GetTags()["origin"]) > 0 {
-			metricName += "." + event.GetTags()["origin"]
+	for _, formula := range nozzle.formulas {
+		if value, ok := formula.Eval(origin, event.GetGauge().GetMetrics()); ok {
+			metricName := nozzle.metricName(naming.Gauge, "", origin, formula.Name, formula.Unit, event)
+			nozzle.wf.SendMetric(metricName, value, ts, source, tags)
 		}
+	}
+
+	if nozzle.rollups != nil && origin == "rep" {
+		nozzle.rollups.update(event, tags, ts)
+	}
+}
+
+// BuildTimerEvent records the timer duration (in milliseconds) into a per app, route and status code distribution
+func (nozzle *Nozzle) BuildTimerEvent(event *loggregator_v2.Envelope) {
+	nozzle.numTimerEventReceived.Inc(1)
+
+	timer := event.GetTimer()
+	if timer.GetStop() < timer.GetStart() {
+		return
+	}
+
+	metricName := nozzle.metricName(naming.Timer, "", event.GetTags()["origin"], timer.GetName(), "", event)
+
+	duration := float64(timer.GetStop()-timer.GetStart()) / float64(time.Millisecond)
+	nozzle.timers.update(metricName, duration, nozzle.getSource(event), nozzle.getTimerTags(event))
+}
+
+// BuildEvent forwards Event envelopes (app crashes, lifecycle events...) as Wavefront events
+func (nozzle *Nozzle) BuildEvent(envelope *loggregator_v2.Envelope) {
+	nozzle.numEventReceived.Inc(1)
+
+	title := envelope.GetEvent().GetTitle()
+	if len(title) == 0 {
+		return
+	}
+
+	options := []event.Option{event.Details(envelope.GetEvent().GetBody())}
+	if origin := envelope.GetTags()["origin"]; len(origin) > 0 {
+		options = append(options, event.Type(origin))
+	}
+
+	source, tags, ts := nozzle.getMetricInfo(envelope)
+	nozzle.wf.SendEvent(title, ts/int64(time.Millisecond), source, tags, options...)
+}
+
+// BuildLogEvent counts the log line and applies the extraction rules, log lines are never forwarded
+func (nozzle *Nozzle) BuildLogEvent(event *loggregator_v2.Envelope) {
+	nozzle.numLogReceived.Inc(1)
+
+	if nozzle.enableLogMetrics {
+		nozzle.logs.update(getSourceID(event), event.GetLog(), logSourceType(event), func() map[string]string {
+			return nozzle.getLogTags(event)
+		})
+	}
+
+	if len(nozzle.logRules) > 0 {
+		nozzle.extractLogMetrics(event)
+	}
+}
+
+func (nozzle *Nozzle) extractLogMetrics(event *loggregator_v2.Envelope) {
+	tags := nozzle.getLogTags(event)
+	line := string(event.GetLog().GetPayload())
 
-		metricName += "." + name
-		if len(metric.GetUnit()) > 0 {
-			metricName += "." + metric.GetUnit()
+	for _, rule := range nozzle.logRules {
+		if !rule.Match(tags["source_id"], tags["applicationName"]) {
+			continue
 		}
 
-		if translate {
-			if newName, ok := translateStrs[metricName]; ok {
-				metricName = newName
+		value, ruleTags, ok := rule.Extract(line)
+		if !ok {
+			continue
+		}
+		for k, v := range tags {
+			if _, ok := ruleTags[k]; !ok {
+				ruleTags[k] = v
 			}
 		}
-
-		source, tags, ts := nozzle.getMetricInfo(event)
-		nozzle.wf.SendMetric(metricName, metric.Value, ts, source, tags)
+		nozzle.wf.SendMetric(nozzle.prefix+"."+rule.Metric, value, event.GetTimestamp(), nozzle.getSource(event), ruleTags)
 	}
 }
 
+// getMetricInfo returns the source, tags and timestamp of the envelope, the tags are only valid until the next envelope
 func (nozzle *Nozzle) getMetricInfo(event *loggregator_v2.Envelope) (string, map[string]string, int64) {
 	source := nozzle.getSource(event)
 	tags := nozzle.getTags(event)
@@ -153,19 +311,37 @@ func (nozzle *Nozzle) getSource(event *loggregator_v2.Envelope) string {
 	if len(source) == 0 {
 		source = event.GetTags()["job"]
 		if len(source) == 0 {
-			hostName, err := os.Hostname()
-			if err == nil {
-				source = hostName
-			} else {
-				source = "unknown"
-			}
+			source = hostname
 		}
 	}
 	return source
 }
 
+func getHostname() string {
+	hostName, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostName
+}
+
+// metricName returns the metric name given by the naming rules, the rules match the envelope tags
+func (nozzle *Nozzle) metricName(kind, suffix, origin, name, unit string, event *loggregator_v2.Envelope) string {
+	if nozzle.names == nil {
+		nozzle.names = newMetricNames(nozzle.prefix, nil)
+	}
+	return nozzle.names.get(kind, suffix, origin, name, unit, event.GetTags())
+}
+
+// getTags fills the worker tags map with the envelope tags, it's cleared and reused for the next envelope
 func (nozzle *Nozzle) getTags(event *loggregator_v2.Envelope) map[string]string {
-	tags := make(map[string]string)
+	if nozzle.tags == nil {
+		nozzle.tags = make(map[string]string)
+	}
+	tags := nozzle.tags
+	for k := range tags {
+		delete(tags, k)
+	}
 
 	if deployment, ok := event.GetTags()["deployment"]; ok {
 		tags["deployment"] = deployment
@@ -175,21 +351,8 @@ func (nozzle *Nozzle) getTags(event *loggregator_v2.Envelope) map[string]string
 		tags["job"] = job
 	}
 
-	if nozzle.Api != nil {
-		if event.GetTags()["origin"] == "rep" {
-			if appName, ok := event.GetTags()["app_name"]; ok {
-				tags["applicationName"] = appName
-				tags["org"] = event.GetTags()["organization_name"]
-				tags["space"] = event.GetTags()["space_name"]
-			} else if sourceID, ok := event.GetTags()["source_id"]; ok && nozzle.enableAppTagLookups {
-				app := nozzle.Api.GetApp(sourceID)
-				if app != nil {
-					tags["applicationName"] = app.Name
-					tags["org"] = app.Org
-					tags["space"] = app.Space
-				}
-			}
-		}
+	if event.GetTags()["origin"] == "rep" || event.GetEvent() != nil {
+		nozzle.addAppTags(event, event.GetTags()["source_id"], tags)
 	}
 
 	tags["foundation"] = nozzle.foundation
@@ -206,3 +369,71 @@ func (nozzle *Nozzle) getTags(event *loggregator_v2.Envelope) map[string]string
 
 	return tags
 }
+
+func (nozzle *Nozzle) getTimerTags(event *loggregator_v2.Envelope) map[string]string {
+	tags := make(map[string]string)
+
+	for _, k := range timerTags {
+		if v := event.GetTags()[k]; len(v) > 0 {
+			tags[k] = v
+		}
+	}
+
+	if uri := event.GetTags()["uri"]; len(uri) > 0 {
+		if u, err := url.Parse(uri); err == nil && len(u.Host) > 0 {
+			tags["route"] = u.Host
+		}
+	}
+
+	sourceID := getSourceID(event)
+	if len(sourceID) > 0 {
+		tags["source_id"] = sourceID
+	}
+
+	nozzle.addAppTags(event, sourceID, tags)
+	tags["foundation"] = nozzle.foundation
+
+	return tags
+}
+
+func (nozzle *Nozzle) getLogTags(event *loggregator_v2.Envelope) map[string]string {
+	tags := make(map[string]string)
+
+	sourceID := getSourceID(event)
+	if len(sourceID) > 0 {
+		tags["source_id"] = sourceID
+	}
+
+	nozzle.addAppTags(event, sourceID, tags)
+	tags["foundation"] = nozzle.foundation
+
+	return tags
+}
+
+// addAppTags adds the application name, org and space, from the envelope or from the apps cache
+func (nozzle *Nozzle) addAppTags(event *loggregator_v2.Envelope, sourceID string, tags map[string]string) {
+	if nozzle.Api == nil {
+		return
+	}
+
+	if appName, ok := event.GetTags()["app_name"]; ok {
+		tags["applicationName"] = appName
+		tags["org"] = event.GetTags()["organization_name"]
+		tags["space"] = event.GetTags()["space_name"]
+	} else if len(sourceID) > 0 && nozzle.enableAppTagLookups {
+		app := nozzle.Api.GetApp(sourceID)
+		if app != nil {
+			tags["applicationName"] = app.Name
+			tags["org"] = app.Org
+			tags["space"] = app.Space
+		}
+	}
+}
+
+// getSourceID returns the 'source_id' tag, or the envelope source id when the tag is missing
+func getSourceID(event *loggregator_v2.Envelope) string {
+	if sourceID, ok := event.GetTags()["source_id"]; ok {
+		return sourceID
+	}
+	return event.GetSourceId()
+}
@@ -1,10 +1,26 @@
 package nozzle
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+
 	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
 	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/api"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/derived"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/logrules"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/naming"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/wavefront"
+	"github.com/wavefronthq/wavefront-sdk-go/event"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -47,6 +63,10 @@ func (nozzle *MockApiClient) GetApp(guid string) *api.AppInfo {
 	return nil
 }
 
+func (nozzle *MockApiClient) AppGuidsByName(names []string) ([]string, error) {
+	return nil, nil
+}
+
 func TestDoesntDoAppTagLookups(t *testing.T) {
 	mockApiClient := NewMockApiClient()
 	nozzle := &Nozzle{
@@ -64,3 +84,798 @@ func TestDoesntDoAppTagLookups(t *testing.T) {
 	nozzle.getTags(event)
 	assert.Equal(t, int64(0), atomic.LoadInt64(&mockApiClient.GetAppCallCount), "don't do GetApp tag lookups")
 }
+
+type mockWavefront struct {
+	metrics       map[string]float64
+	distributions map[string][]histogram.Centroid
+	events        []string
+	tags          map[string]map[string]string
+	closed        bool
+}
+
+func newMockWavefront() *mockWavefront {
+	return &mockWavefront{
+		metrics:       make(map[string]float64),
+		distributions: make(map[string][]histogram.Centroid),
+		tags:          make(map[string]map[string]string),
+	}
+}
+
+func (wf *mockWavefront) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) {
+	wf.metrics[name] = value
+	wf.tags[name] = utils.CopyTags(tags)
+}
+
+func (wf *mockWavefront) SendDeltaCounter(name string, value float64, source string, tags map[string]string) {
+	wf.metrics[name] += value
+	wf.tags[name] = utils.CopyTags(tags)
+}
+
+func (wf *mockWavefront) SendDistribution(name string, centroids []histogram.Centroid, ts int64, source string, tags map[string]string) {
+	wf.distributions[name] = append(wf.distributions[name], centroids...)
+	wf.tags[name] = utils.CopyTags(tags)
+}
+
+func (wf *mockWavefront) SendEvent(name string, ts int64, source string, tags map[string]string, setters ...event.Option) {
+	wf.events = append(wf.events, name)
+	wf.tags[name] = utils.CopyTags(tags)
+}
+
+func (wf *mockWavefront) ReportError(err error) {}
+
+func (wf *mockWavefront) Close() {
+	wf.closed = true
+}
+
+func TestTimerTags(t *testing.T) {
+	nozzle := &Nozzle{foundation: "foo"}
+
+	event := &loggregator_v2.Envelope{
+		SourceId: "some-guid",
+		Tags: map[string]string{
+			"origin":      "gorouter",
+			"source_id":   "some-guid",
+			"status_code": "200",
+			"method":      "GET",
+			"uri":         "https://app.example.com/some/path?q=1",
+			"request_id":  "f00b4r",
+			"user_agent":  "curl",
+		},
+	}
+
+	tags := nozzle.getTimerTags(event)
+	assert.Equal(t, "app.example.com", tags["route"])
+	assert.Equal(t, "200", tags["status_code"])
+	assert.Equal(t, "GET", tags["method"])
+	assert.Equal(t, "foo", tags["foundation"])
+	assert.NotContains(t, tags, "request_id")
+	assert.NotContains(t, tags, "user_agent")
+	assert.NotContains(t, tags, "uri")
+}
+
+func TestBuildTimerEvent(t *testing.T) {
+	wf := newMockWavefront()
+	timers := newTimerAggregator(wf)
+	received := metrics.NewCounter()
+	var workers []*Nozzle
+	for i := 0; i < 2; i++ {
+		workers = append(workers, &Nozzle{
+			prefix:                "pcf",
+			wf:                    wf,
+			timers:                timers,
+			numTimerEventReceived: received,
+		})
+	}
+
+	for i, d := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, -time.Millisecond} {
+		workers[i%len(workers)].BuildTimerEvent(&loggregator_v2.Envelope{
+			Tags: map[string]string{"origin": "gorouter", "ip": "1.2.3.4", "status_code": "200"},
+			Message: &loggregator_v2.Envelope_Timer{
+				Timer: &loggregator_v2.Timer{Name: "http", Start: 1000, Stop: 1000 + int64(d)},
+			},
+		})
+	}
+
+	assert.Equal(t, int64(3), received.Count())
+	assert.Equal(t, 1, len(timers.series), "the workers share the series")
+	for _, s := range timers.series {
+		assert.Equal(t, "pcf.gorouter.http.latency.ms", s.name)
+		assert.Equal(t, "1.2.3.4", s.source)
+	}
+}
+
+type appInfoApiClient struct {
+	*MockApiClient
+	app   *api.AppInfo
+	guids map[string]string
+}
+
+func (client *appInfoApiClient) GetApp(guid string) *api.AppInfo {
+	return client.app
+}
+
+func (client *appInfoApiClient) AppGuidsByName(names []string) ([]string, error) {
+	var guids []string
+	for _, name := range names {
+		if guid, ok := client.guids[name]; ok {
+			guids = append(guids, guid)
+		}
+	}
+	return guids, nil
+}
+
+func TestBuildEvent(t *testing.T) {
+	wf := newMockWavefront()
+	nozzle := &Nozzle{
+		foundation:          "foo",
+		wf:                  wf,
+		numEventReceived:    metrics.NewCounter(),
+		enableAppTagLookups: true,
+		Api: &appInfoApiClient{
+			MockApiClient: NewMockApiClient(),
+			app:           &api.AppInfo{Name: "some-app", Org: "some-org", Space: "some-space"},
+		},
+	}
+
+	nozzle.BuildEvent(&loggregator_v2.Envelope{
+		Timestamp: time.Now().UnixNano(),
+		Tags:      map[string]string{"origin": "cloud_controller", "source_id": "some-guid"},
+		Message: &loggregator_v2.Envelope_Event{
+			Event: &loggregator_v2.Event{Title: "app crashed", Body: "exit status 137"},
+		},
+	})
+
+	assert.Equal(t, []string{"app crashed"}, wf.events)
+	tags := wf.tags["app crashed"]
+	assert.Equal(t, "some-app", tags["applicationName"])
+	assert.Equal(t, "some-org", tags["org"])
+	assert.Equal(t, "some-space", tags["space"])
+	assert.Equal(t, "foo", tags["foundation"])
+}
+
+func TestBuildLogEvent(t *testing.T) {
+	wf := newMockWavefront()
+	nozzle := &Nozzle{
+		foundation:       "foo",
+		wf:               wf,
+		logs:             newLogAggregator("pcf", wf),
+		numLogReceived:   metrics.NewCounter(),
+		enableLogMetrics: true,
+	}
+
+	logs := []struct {
+		logType    loggregator_v2.Log_Type
+		sourceType string
+	}{
+		{loggregator_v2.Log_OUT, "APP/PROC/WEB/0"},
+		{loggregator_v2.Log_OUT, "APP/PROC/WEB/1"},
+		{loggregator_v2.Log_ERR, "APP/PROC/WEB/0"},
+		{loggregator_v2.Log_OUT, "RTR/0"},
+	}
+	for _, l := range logs {
+		nozzle.BuildLogEvent(&loggregator_v2.Envelope{
+			SourceId: "some-guid",
+			Tags:     map[string]string{"source_type": l.sourceType},
+			Message: &loggregator_v2.Envelope_Log{
+				Log: &loggregator_v2.Log{Payload: []byte("hello"), Type: l.logType},
+			},
+		})
+	}
+
+	assert.Equal(t, int64(4), nozzle.numLogReceived.Count())
+	assert.Equal(t, 3, len(nozzle.logs.counts))
+	for _, c := range nozzle.logs.counts {
+		assert.Equal(t, "some-guid", c.tags["source_id"])
+		if c.tags["log_type"] == "stdout" && c.tags["source_type"] == "APP" {
+			assert.Equal(t, int64(2), c.lines)
+			assert.Equal(t, int64(10), c.bytes)
+		}
+	}
+
+	nozzle.logs.flush()
+	assert.Equal(t, 4.0, wf.metrics["pcf.logs.lines"])
+	assert.Equal(t, 20.0, wf.metrics["pcf.logs.bytes"])
+	assert.Equal(t, 0, len(nozzle.logs.counts))
+}
+
+func TestScopedSelectors(t *testing.T) {
+	client := &appInfoApiClient{
+		MockApiClient: NewMockApiClient(),
+		guids:         map[string]string{"app-1": "guid-1", "app-2": "guid-2"},
+	}
+	conf := &config.NozzleConfig{
+		SourceIDs: []string{"some-guid", " "},
+		AppNames:  []string{"app-1", "app-2", "app-3"},
+	}
+
+	sourceIDs, err := resolveSourceIDs(conf, client)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"some-guid", "guid-1", "guid-2"}, sourceIDs)
+
+	selectors := scopeSelectors(defaultSelectors, sourceIDs)
+	assert.Equal(t, 6, len(selectors))
+	assert.Equal(t, "guid-2", selectors[5].GetSourceId())
+	assert.NotNil(t, selectors[5].GetGauge())
+
+	assert.Equal(t, defaultSelectors, scopeSelectors(defaultSelectors, nil))
+
+	conf.AppNames = []string{"app-3"}
+	_, err = resolveSourceIDs(conf, client)
+	assert.Error(t, err)
+
+	// a failed resolution on reconnection keeps the current source ids
+	assert.Equal(t, sourceIDs, refreshSourceIDs(conf, client, sourceIDs))
+	conf.AppNames = []string{"app-1"}
+	assert.Equal(t, []string{"some-guid", "guid-1"}, refreshSourceIDs(conf, client, sourceIDs))
+}
+
+func TestSelectedEvents(t *testing.T) {
+	selectors, err := ParseSelectedEvents("")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(selectors), selectors)
+
+	selectors, err = ParseSelectedEvents("ValueMetric,CounterEvent,ContainerMetric")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(selectors), selectors)
+
+	selectors, err = ParseSelectedEvents("[Counter Gauge Timer Event Log]")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(selectors), selectors)
+
+	_, err = ParseSelectedEvents("Gauge,Gau__ge")
+	assert.Error(t, err)
+}
+
+func TestLogMetricsEnabled(t *testing.T) {
+	rules := logrules.Rules{&logrules.Rule{}}
+	assert.True(t, logMetricsEnabled(&config.NozzleConfig{}))
+	assert.True(t, logMetricsEnabled(&config.NozzleConfig{EnableLogs: true, LogRules: rules}))
+	assert.True(t, logMetricsEnabled(&config.NozzleConfig{SelectedEvents: "Counter,Log", LogRules: rules}), "logs selected")
+	assert.False(t, logMetricsEnabled(&config.NozzleConfig{LogRules: rules}), "logs streamed only for the rules")
+}
+
+func TestBackoff(t *testing.T) {
+	bo := &backoff{min: time.Second, max: 10 * time.Second}
+
+	for _, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		delay := bo.next()
+		assert.True(t, delay >= max*time.Second/2, delay)
+		assert.True(t, delay <= max*time.Second, delay)
+	}
+
+	bo.reset()
+	assert.True(t, bo.next() <= time.Second)
+}
+
+func TestConnectionStall(t *testing.T) {
+	conn := newConnection()
+	go conn.watch(40 * time.Millisecond)
+
+	select {
+	case <-conn.ctx.Done():
+	case <-time.After(time.Second):
+		assert.FailNow(t, "stalled connection not closed")
+	}
+	assert.Equal(t, reasonStall, conn.reason)
+
+	conn.close(reasonAuthError)
+	assert.Equal(t, reasonStall, conn.reason, "only the first reason is kept")
+}
+
+func TestStopDrainsWorker(t *testing.T) {
+	wf := newMockWavefront()
+	events := make(chan *loggregator_v2.Envelope, 10)
+	nozzle := &Nozzle{
+		prefix:           "pcf",
+		wf:               wf,
+		eventsChannel:    events,
+		timers:           newTimerAggregator(wf),
+		deltas:           newDeltaAggregator(wf),
+		logs:             newLogAggregator("pcf", wf),
+		numLogReceived:   metrics.NewCounter(),
+		enableLogMetrics: true,
+		done:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+	}
+	go nozzle.run()
+
+	for i := 0; i < 5; i++ {
+		events <- &loggregator_v2.Envelope{
+			SourceId: "some-guid",
+			Message:  &loggregator_v2.Envelope_Log{Log: &loggregator_v2.Log{Payload: []byte("hello")}},
+		}
+	}
+	for len(events) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	nozzle.Stop()
+
+	assert.Equal(t, 5.0, wf.metrics["pcf.logs.lines"])
+	assert.True(t, wf.closed)
+}
+
+// lateWavefront counts the data sent after Close
+type lateWavefront struct {
+	discardWavefront
+	closed int32
+	late   int32
+}
+
+func (wf *lateWavefront) SendDeltaCounter(name string, value float64, source string, tags map[string]string) {
+	if atomic.LoadInt32(&wf.closed) == 1 {
+		atomic.AddInt32(&wf.late, 1)
+	}
+}
+
+func (wf *lateWavefront) SendDistribution(name string, centroids []histogram.Centroid, ts int64, source string, tags map[string]string) {
+	if atomic.LoadInt32(&wf.closed) == 1 {
+		atomic.AddInt32(&wf.late, 1)
+	}
+}
+
+func (wf *lateWavefront) Close() {
+	atomic.StoreInt32(&wf.closed, 1)
+}
+
+func TestAggregatorsStopFlushing(t *testing.T) {
+	wf := &lateWavefront{}
+	timers := newTimerAggregator(wf)
+	logs := newLogAggregator("pcf", wf)
+	deltas := newDeltaAggregator(wf)
+	timers.start(time.Millisecond)
+	logs.start(time.Millisecond)
+	deltas.start(time.Millisecond)
+
+	timers.close()
+	logs.close()
+	deltas.close()
+	wf.Close()
+
+	timers.update("pcf.gorouter.http.latency.ms", 12, "router", map[string]string{})
+	deltas.update("pcf.gorouter.total_requests", 1, "router", map[string]string{})
+	logs.update("some-guid", &loggregator_v2.Log{Payload: []byte("hello")}, "APP", func() map[string]string {
+		return map[string]string{}
+	})
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&wf.late))
+}
+
+func TestSpillBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		assert.FailNow(t, "unable to create temp dir: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sb, err := newSpillBuffer(&config.NozzleConfig{SpillDir: dir, SpillMaxMb: 1}, nil)
+	if err != nil {
+		assert.FailNow(t, "unable to open spill buffer: ", err)
+	}
+
+	events := make(chan *loggregator_v2.Envelope, 4)
+	for i := 0; i < 3; i++ {
+		assert.True(t, sb.push(&loggregator_v2.Envelope{SourceId: fmt.Sprintf("guid-%d", i)}))
+	}
+	assert.Equal(t, int64(3), sb.writes.Count())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	replayed := make(chan struct{})
+	go func() {
+		defer close(replayed)
+		sb.replay(ctx, events)
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case e := <-events:
+			assert.Equal(t, fmt.Sprintf("guid-%d", i), e.GetSourceId())
+		case <-time.After(time.Second):
+			assert.FailNow(t, "spilled envelope not replayed")
+		}
+	}
+	cancel()
+	<-replayed
+	sb.close()
+
+	assert.Equal(t, int64(3), sb.reads.Count())
+	assert.Equal(t, int64(0), sb.queue.Len())
+}
+
+func TestStreamConnector(t *testing.T) {
+	_, err := newStreamConnector(&config.NozzleConfig{RLPTransport: "websocket"}, nil, nil)
+	assert.NotNil(t, err)
+
+	_, err = newStreamConnector(&config.NozzleConfig{RLPTransport: transportGateway}, nil, nil)
+	assert.NotNil(t, err)
+
+	connect, err := newStreamConnector(&config.NozzleConfig{RLPTransport: transportGateway, LogStreamURL: "https://log-stream.local"}, nil, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, connect)
+
+	_, err = newStreamConnector(&config.NozzleConfig{RLPTransport: transportGRPC}, nil, nil)
+	assert.NotNil(t, err)
+
+	_, err = newStreamConnector(&config.NozzleConfig{
+		RLPTransport:  transportGRPC,
+		RLPAddr:       "reverselogproxy.local:8082",
+		RLPCACertFile: "missing-ca.crt",
+		RLPCertFile:   "missing.crt",
+		RLPKeyFile:    "missing.key",
+	}, nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestSyslogReceiver(t *testing.T) {
+	r, err := newSyslogReceiver(&config.NozzleConfig{SyslogAddr: "127.0.0.1:0"}, nil)
+	assert.Nil(t, err)
+	defer r.listener.Close()
+	ignored := r.ignored.Count()
+
+	conn, err := net.Dial("tcp", r.listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	messages := []string{
+		`<14>1 2020-05-01T10:20:30Z org.space.app app-guid [APP/PROC/WEB/0] - - a log line`,
+		`<14>1 2020-05-01T10:20:30Z org.space.app app-guid [1] - [gauge@47450 name="cpu" value="0.5" unit="percentage"][gauge@47450 name="memory" value="1024" unit="bytes"][tags@47450 origin="rep" deployment="cf"]`,
+		`<14>1 2020-05-01T10:20:31Z org.space.app app-guid [2] - [counter@47450 name="requests" total="10" delta="2"]`,
+		`<14>1 - org.space.app app-guid [3] - [counter@47450 name="requests" total="12" delta="2"]`,
+	}
+	for _, msg := range messages {
+		fmt.Fprintf(conn, "%d %s", len(msg), msg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	es := r.stream(ctx)
+
+	batch := es()
+	assert.Len(t, batch, 1)
+	gauge := batch[0]
+	assert.Equal(t, "app-guid", gauge.GetSourceId())
+	assert.Equal(t, "1", gauge.GetInstanceId())
+	assert.Equal(t, map[string]string{"origin": "rep", "deployment": "cf", "source_id": "app-guid"}, gauge.GetTags())
+	assert.Equal(t, 0.5, gauge.GetGauge().GetMetrics()["cpu"].GetValue())
+	assert.Equal(t, "bytes", gauge.GetGauge().GetMetrics()["memory"].GetUnit())
+
+	batch = es()
+	assert.Len(t, batch, 1)
+	counter := batch[0].GetCounter()
+	assert.Equal(t, "requests", counter.GetName())
+	assert.Equal(t, uint64(10), counter.GetTotal())
+	assert.Equal(t, uint64(2), counter.GetDelta())
+	assert.Equal(t, time.Date(2020, 5, 1, 10, 20, 31, 0, time.UTC).UnixNano(), batch[0].GetTimestamp())
+	assert.Equal(t, int64(1), r.ignored.Count()-ignored)
+
+	batch = es()
+	assert.Len(t, batch, 1)
+	assert.InDelta(t, time.Now().UnixNano(), batch[0].GetTimestamp(), float64(time.Minute), "no timestamp, the time received")
+
+	wf := newMockWavefront()
+	nozzle := &Nozzle{wf: wf, prefix: "pcf", numGaugeMetricReceived: metrics.NewCounter()}
+	nozzle.BuildGaugeEvent(gauge)
+	assert.Contains(t, wf.metrics, "pcf.container.rep.cpu_percentage")
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := dir + "/envelopes.cap"
+
+	r, err := newRecorder(path, nil)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		r.Record(&loggregator_v2.Envelope{
+			SourceId: fmt.Sprintf("source-%d", i),
+			Message: &loggregator_v2.Envelope_Counter{
+				Counter: &loggregator_v2.Counter{Name: "requests", Total: uint64(i)},
+			},
+		})
+	}
+	r.Close()
+
+	events := make(chan *loggregator_v2.Envelope, 10)
+	err = replayFile(context.Background(), path, 0, events, metrics.NewCounter())
+	assert.Nil(t, err)
+	assert.Len(t, events, 3)
+	for i := 0; i < 3; i++ {
+		e := <-events
+		assert.Equal(t, fmt.Sprintf("source-%d", i), e.GetSourceId())
+		assert.Equal(t, uint64(i), e.GetCounter().GetTotal())
+	}
+
+	err = replayFile(context.Background(), dir+"/missing.cap", 0, events, metrics.NewCounter())
+	assert.NotNil(t, err)
+}
+
+// discardWavefront drops the data points, to measure the conversion alone
+type discardWavefront struct{}
+
+func (discardWavefront) SendMetric(name string, value float64, ts int64, source string, tags map[string]string) {
+}
+func (discardWavefront) SendDeltaCounter(name string, value float64, source string, tags map[string]string) {
+}
+func (discardWavefront) SendDistribution(name string, centroids []histogram.Centroid, ts int64, source string, tags map[string]string) {
+}
+func (discardWavefront) SendEvent(name string, ts int64, source string, tags map[string]string, setters ...event.Option) {
+}
+func (discardWavefront) ReportError(err error) {}
+func (discardWavefront) Close()                {}
+
+func newBenchmarkNozzle(wf wavefront.Wavefront) *Nozzle {
+	return &Nozzle{
+		prefix:                  "pcf",
+		foundation:              "foo",
+		wf:                      wf,
+		names:                   newMetricNames("pcf", nil),
+		tags:                    make(map[string]string),
+		formulas:                derived.Default(),
+		numGaugeMetricReceived:  metrics.NewCounter(),
+		numCounterEventReceived: metrics.NewCounter(),
+	}
+}
+
+func gaugeEnvelope() *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: time.Now().UnixNano(),
+		Tags:      map[string]string{"origin": "bosh-system-metrics-forwarder", "deployment": "cf", "job": "diego_cell", "index": "0", "ip": "10.0.0.1"},
+		Message: &loggregator_v2.Envelope_Gauge{Gauge: &loggregator_v2.Gauge{Metrics: map[string]*loggregator_v2.GaugeValue{
+			"system.cpu.user": {Unit: "percent", Value: 12.5},
+			"system.mem.kb":   {Unit: "kb", Value: 1024},
+		}}},
+	}
+}
+
+func containerEnvelope() *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: time.Now().UnixNano(),
+		SourceId:  "some-guid",
+		Tags:      map[string]string{"origin": "rep", "deployment": "cf", "job": "diego_cell", "source_id": "some-guid", "instance_id": "0"},
+		Message: &loggregator_v2.Envelope_Gauge{Gauge: &loggregator_v2.Gauge{Metrics: map[string]*loggregator_v2.GaugeValue{
+			"cpu":          {Unit: "percentage", Value: 3.2},
+			"memory":       {Unit: "bytes", Value: 128 << 20},
+			"memory_quota": {Unit: "bytes", Value: 256 << 20},
+			"disk":         {Unit: "bytes", Value: 64 << 20},
+			"disk_quota":   {Unit: "bytes", Value: 1 << 30},
+		}}},
+	}
+}
+
+func counterEnvelope() *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: time.Now().UnixNano(),
+		Tags:      map[string]string{"origin": "gorouter", "deployment": "cf", "job": "router", "ip": "10.0.0.2"},
+		Message:   &loggregator_v2.Envelope_Counter{Counter: &loggregator_v2.Counter{Name: "total_requests", Total: 1000, Delta: 10}},
+	}
+}
+
+func TestMetricNames(t *testing.T) {
+	wf := newMockWavefront()
+	nozzle := &Nozzle{prefix: "pcf", wf: wf, numGaugeMetricReceived: metrics.NewCounter(), numCounterEventReceived: metrics.NewCounter()}
+
+	nozzle.BuildGaugeEvent(gaugeEnvelope())
+	nozzle.BuildGaugeEvent(containerEnvelope())
+	nozzle.BuildCounterEvent(counterEnvelope())
+
+	assert.Equal(t, 12.5, wf.metrics["pcf.bosh-system-metrics-forwarder.system.cpu.user.percent"])
+	assert.Equal(t, 3.2, wf.metrics["pcf.container.rep.cpu_percentage"])
+	assert.Equal(t, float64(256<<20), wf.metrics["pcf.container.rep.memory_bytes_quota"])
+	assert.Equal(t, 1000.0, wf.metrics["pcf.gorouter.total_requests.total"])
+	assert.Equal(t, 10.0, wf.metrics["pcf.gorouter.total_requests.delta"])
+	assert.Equal(t, "cf", wf.tags["pcf.container.rep.disk_bytes"]["deployment"])
+	assert.Equal(t, "some-guid", wf.tags["pcf.container.rep.disk_bytes"]["source_id"])
+	assert.NotContains(t, wf.tags["pcf.gorouter.total_requests.total"], "source_id", "tags are cleared between envelopes")
+
+	nozzle.names.names = make(map[nameKey]string, maxCachedNames)
+	for i := 0; i < maxCachedNames; i++ {
+		nozzle.names.get(naming.Gauge, "", "", fmt.Sprint(i), "", nil)
+	}
+	assert.Equal(t, "pcf.rep.cpu", nozzle.names.get(naming.Gauge, "", "rep", "cpu", "", nil))
+	assert.Len(t, nozzle.names.names, 1, "a full cache starts over")
+}
+
+func TestConversionAllocations(t *testing.T) {
+	nozzle := newBenchmarkNozzle(discardWavefront{})
+	gauge, container, counter := gaugeEnvelope(), containerEnvelope(), counterEnvelope()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		nozzle.BuildGaugeEvent(gauge)
+		nozzle.BuildGaugeEvent(container)
+		nozzle.BuildCounterEvent(counter)
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func BenchmarkBuildGaugeEvent(b *testing.B) {
+	nozzle := newBenchmarkNozzle(discardWavefront{})
+	envelope := gaugeEnvelope()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		nozzle.BuildGaugeEvent(envelope)
+	}
+}
+
+func BenchmarkBuildContainerGaugeEvent(b *testing.B) {
+	nozzle := newBenchmarkNozzle(discardWavefront{})
+	envelope := containerEnvelope()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		nozzle.BuildGaugeEvent(envelope)
+	}
+}
+
+func BenchmarkBuildCounterEvent(b *testing.B) {
+	nozzle := newBenchmarkNozzle(discardWavefront{})
+	envelope := counterEnvelope()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		nozzle.BuildCounterEvent(envelope)
+	}
+}
+
+// BenchmarkHandleEvent measures a worker on a mix of container metrics, gauges and counters
+func BenchmarkHandleEvent(b *testing.B) {
+	nozzle := newBenchmarkNozzle(discardWavefront{})
+	envelopes := []*loggregator_v2.Envelope{
+		containerEnvelope(), gaugeEnvelope(), counterEnvelope(),
+		gaugeEnvelope(), counterEnvelope(), gaugeEnvelope(), gaugeEnvelope(),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		nozzle.handleEvent(envelopes[i%len(envelopes)])
+	}
+}
+
+func TestCounterModes(t *testing.T) {
+	_, err := newCounterConverter(&config.NozzleConfig{CounterModes: []string{"pcf.*"}}, nil)
+	assert.NotNil(t, err)
+	_, err = newCounterConverter(&config.NozzleConfig{CounterModes: []string{"pcf.*=rate"}}, nil)
+	assert.NotNil(t, err)
+	_, err = newCounterConverter(&config.NozzleConfig{CounterRates: []string{"pcf.["}}, nil)
+	assert.NotNil(t, err)
+
+	counters, err := newCounterConverter(&config.NozzleConfig{
+		DeltaCounters: true,
+		CounterModes:  []string{"pcf.gorouter.*=delta", " pcf.uaa.* = total "},
+	}, nil)
+	assert.Nil(t, err)
+
+	wf := newMockWavefront()
+	nozzle := &Nozzle{
+		prefix:                  "pcf",
+		wf:                      wf,
+		deltas:                  newDeltaAggregator(wf),
+		counters:                counters,
+		numCounterEventReceived: metrics.NewCounter(),
+	}
+
+	send := func(origin, name string, total, delta uint64) {
+		nozzle.BuildCounterEvent(&loggregator_v2.Envelope{
+			Timestamp: time.Now().UnixNano(),
+			Tags:      map[string]string{"origin": origin, "ip": "10.0.0.1"},
+			Message:   &loggregator_v2.Envelope_Counter{Counter: &loggregator_v2.Counter{Name: name, Total: total, Delta: delta}},
+		})
+	}
+	send("gorouter", "total_requests", 100, 10)
+	send("gorouter", "total_requests", 120, 20)
+	send("uaa", "requests", 50, 5)
+	send("doppler", "ingress", 70, 7)
+
+	assert.NotContains(t, wf.metrics, "pcf.gorouter.total_requests.total")
+	assert.NotContains(t, wf.metrics, "pcf.gorouter.total_requests.delta", "deltas are aggregated until the flush")
+	assert.Equal(t, 50.0, wf.metrics["pcf.uaa.requests.total"])
+	assert.NotContains(t, wf.metrics, "pcf.uaa.requests.delta")
+	assert.Equal(t, 70.0, wf.metrics["pcf.doppler.ingress.total"])
+
+	nozzle.deltas.flush()
+	assert.Equal(t, 30.0, wf.metrics["pcf.gorouter.total_requests.delta"])
+	assert.Equal(t, 7.0, wf.metrics["pcf.doppler.ingress.delta"])
+	assert.Equal(t, "10.0.0.1", wf.tags["pcf.gorouter.total_requests.delta"]["ip"])
+	assert.Empty(t, nozzle.deltas.series)
+}
+
+func TestCounterRate(t *testing.T) {
+	counters, err := newCounterConverter(&config.NozzleConfig{CounterRates: []string{"pcf.gorouter.*"}, CounterRateExpiration: time.Minute}, nil)
+	assert.Nil(t, err)
+	assert.True(t, counters.convertToRate("pcf.gorouter.total_requests"))
+	assert.False(t, counters.convertToRate("pcf.uaa.requests"))
+
+	tags := map[string]string{"job": "router"}
+	sec := int64(time.Second)
+	resets, wraps, expired := counters.resets.Count(), counters.wraps.Count(), counters.expired.Count()
+
+	_, ok := counters.rate("requests.rate", "10.0.0.1", tags, 100, 10*sec)
+	assert.False(t, ok, "no rate for the first total")
+
+	rate, ok := counters.rate("requests.rate", "10.0.0.1", tags, 150, 20*sec)
+	assert.True(t, ok)
+	assert.Equal(t, 5.0, rate)
+
+	_, ok = counters.rate("requests.rate", "10.0.0.1", tags, 160, 15*sec)
+	assert.False(t, ok, "out of order totals are ignored")
+
+	// the router restarted
+	rate, ok = counters.rate("requests.rate", "10.0.0.1", tags, 30, 30*sec)
+	assert.True(t, ok)
+	assert.Equal(t, 3.0, rate)
+	assert.Equal(t, int64(1), counters.resets.Count()-resets)
+
+	// the totals are 64 bits, a total around the 32 bits max going back to zero is a reset
+	_, _ = counters.rate("packets.rate", "10.0.0.1", tags, math.MaxUint32-9, 10*sec)
+	rate, ok = counters.rate("packets.rate", "10.0.0.1", tags, 10, 20*sec)
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, rate)
+	assert.Equal(t, int64(2), counters.resets.Count()-resets)
+
+	// a 64 bits total wrapped around
+	_, _ = counters.rate("packets.rate", "10.0.0.1", tags, math.MaxUint64-9, 30*sec)
+	rate, ok = counters.rate("packets.rate", "10.0.0.1", tags, 10, 40*sec)
+	assert.True(t, ok)
+	assert.Equal(t, 2.0, rate)
+	assert.Equal(t, int64(1), counters.wraps.Count()-wraps)
+
+	// series are kept by name, source and tags
+	_, ok = counters.rate("requests.rate", "10.0.0.2", tags, 30, 40*sec)
+	assert.False(t, ok)
+	assert.Equal(t, int64(3), counters.size())
+
+	for _, s := range counters.series {
+		s.lastSeen = time.Now().Add(-2 * time.Minute)
+	}
+	counters.series[utils.SeriesKey("packets.rate", "10.0.0.1", tags)].lastSeen = time.Now()
+	counters.expire()
+	assert.Equal(t, int64(1), counters.size())
+	assert.Equal(t, int64(2), counters.expired.Count()-expired)
+}
+
+func TestAppRollups(t *testing.T) {
+	wf := newMockWavefront()
+	rollups := &appRollups{prefix: "pcf", wf: wf, instances: make(map[instanceKey]*instanceMetrics), done: make(chan struct{})}
+	nozzle := newBenchmarkNozzle(discardWavefront{})
+	nozzle.Api = NewMockApiClient()
+	nozzle.rollups = rollups
+
+	instance := func(id string, cpu float64) *loggregator_v2.Envelope {
+		envelope := containerEnvelope()
+		envelope.Tags["instance_id"] = id
+		envelope.Tags["app_name"] = "some-app"
+		envelope.GetGauge().Metrics["cpu"].Value = cpu
+		return envelope
+	}
+
+	nozzle.BuildGaugeEvent(instance("0", 10))
+	nozzle.BuildGaugeEvent(instance("1", 30))
+	nozzle.BuildGaugeEvent(instance("1", 20))
+	nozzle.BuildGaugeEvent(instance("2", 90))
+	rollups.flush()
+
+	assert.Equal(t, 3.0, wf.metrics["pcf.app.instances"])
+	assert.Equal(t, 40.0, wf.metrics["pcf.app.cpu_percentage.avg"])
+	assert.Equal(t, 90.0, wf.metrics["pcf.app.cpu_percentage.max"])
+	assert.Equal(t, float64(3*128<<20), wf.metrics["pcf.app.memory_bytes"])
+	assert.Equal(t, float64(3*64<<20), wf.metrics["pcf.app.disk_bytes"])
+	assert.Equal(t, float64(3<<30), wf.metrics["pcf.app.disk_bytes_quota"])
+	assert.Equal(t, 6.25, wf.metrics["pcf.app.disk_percentage"])
+	assert.Equal(t, map[string]string{"source_id": "some-guid", "applicationName": "some-app", "foundation": "foo"}, wf.tags["pcf.app.instances"])
+
+	// instances without metrics since the previous flush are gone
+	nozzle.BuildGaugeEvent(instance("0", 10))
+	rollups.close()
+	assert.Equal(t, 1.0, wf.metrics["pcf.app.instances"])
+	assert.Equal(t, int64(1), rollups.size())
+	assert.True(t, wf.closed)
+}
+
+func TestDerivedMetrics(t *testing.T) {
+	wf := newMockWavefront()
+	nozzle := newBenchmarkNozzle(wf)
+
+	nozzle.BuildGaugeEvent(containerEnvelope())
+	nozzle.BuildGaugeEvent(gaugeEnvelope())
+	assert.Equal(t, 50.0, wf.metrics["pcf.container.rep.memory_utilization.percentage"])
+	assert.Equal(t, 6.25, wf.metrics["pcf.container.rep.disk_utilization.percentage"])
+	assert.Equal(t, "some-guid", wf.tags["pcf.container.rep.memory_utilization.percentage"]["source_id"])
+	assert.NotContains(t, wf.metrics, "pcf.container.rep.cpu_entitlement.percentage")
+	assert.Len(t, wf.metrics, 9)
+}
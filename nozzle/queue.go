@@ -0,0 +1,34 @@
+package nozzle
+
+import (
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/backpressure"
+	"github.com/wavefronthq/go-metrics-wavefront/reporting"
+)
+
+// newEnvelopeQueue adapts the events channel to backpressure.Queue and registers its size and usage gauges
+func newEnvelopeQueue(events chan *loggregator_v2.Envelope, internalTags map[string]string) *backpressure.ChanQueue {
+	q := backpressure.NewChanQueue(events)
+	reporting.RegisterMetric("nozzle.queue.size", metrics.NewFunctionalGauge(func() int64 { return int64(q.Cap()) }), internalTags)
+	reporting.RegisterMetric("nozzle.queue.used", metrics.NewFunctionalGauge(q.Used), internalTags)
+	return q
+}
+
+// envelopeType returns the envelope message type, used to break down the queue drops
+func envelopeType(item interface{}) string {
+	switch item.(*loggregator_v2.Envelope).GetMessage().(type) {
+	case *loggregator_v2.Envelope_Counter:
+		return "counter"
+	case *loggregator_v2.Envelope_Gauge:
+		return "gauge"
+	case *loggregator_v2.Envelope_Timer:
+		return "timer"
+	case *loggregator_v2.Envelope_Event:
+		return "event"
+	case *loggregator_v2.Envelope_Log:
+		return "log"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,112 @@
+package nozzle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	loggregator "code.cloudfoundry.org/go-loggregator/v8"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/uaa"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// RLP transports
+const (
+	transportGateway = "gateway"
+	transportGRPC    = "grpc"
+	transportSyslog  = "syslog"
+)
+
+// streamConnector opens the envelope stream of a connection
+type streamConnector func(conn *connection, req *loggregator_v2.EgressBatchRequest) loggregator.EnvelopeStream
+
+// newStreamConnector returns the connector for the configured transport, the RLP gateway over
+// HTTP/JSON with a UAA token, the RLP gRPC endpoint with the loggregator mTLS certificates,
+// or a syslog drains receiver
+func newStreamConnector(conf *config.NozzleConfig, tokens uaa.UAA, internalTags map[string]string) (streamConnector, error) {
+	switch conf.RLPTransport {
+	case transportGateway:
+		if len(conf.LogStreamURL) == 0 {
+			return nil, fmt.Errorf("NOZZLE_LOG_STREAM_URL is required by the '%s' transport", transportGateway)
+		}
+
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: conf.TLS.Clone(),
+		}}
+		utils.Logger.Printf("Connecting to the RLP gateway: %s", conf.LogStreamURL)
+
+		return func(conn *connection, req *loggregator_v2.EgressBatchRequest) loggregator.EnvelopeStream {
+			c := loggregator.NewRLPGatewayClient(
+				conf.LogStreamURL,
+				loggregator.WithRLPGatewayClientLogger(utils.Logger),
+				loggregator.WithRLPGatewayHTTPClient(&tokenAttacher{
+					tokens: tokens,
+					client: client,
+					conn:   conn,
+				}),
+			)
+			return c.Stream(conn.ctx, req)
+		}, nil
+
+	case transportGRPC:
+		if len(conf.RLPAddr) == 0 {
+			return nil, fmt.Errorf("NOZZLE_RLP_ADDR is required by the '%s' transport", transportGRPC)
+		}
+
+		tlsConfig, err := loggregator.NewEgressTLSConfig(conf.RLPCACertFile, conf.RLPCertFile, conf.RLPKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the RLP certificates: %v", err)
+		}
+
+		// the connector logs every failed attempt, which happens every 50ms while the RLP is down
+		logger := log.New(ioutil.Discard, "", 0)
+		if utils.Debug {
+			logger = utils.Logger
+		}
+		connector := loggregator.NewEnvelopeStreamConnector(conf.RLPAddr, tlsConfig, loggregator.WithEnvelopeStreamLogger(logger))
+		utils.Logger.Printf("Connecting to the RLP: %s", conf.RLPAddr)
+
+		return func(conn *connection, req *loggregator_v2.EgressBatchRequest) loggregator.EnvelopeStream {
+			return connector.Stream(conn.ctx, req)
+		}, nil
+
+	case transportSyslog:
+		receiver, err := newSyslogReceiver(conf, internalTags)
+		if err != nil {
+			return nil, fmt.Errorf("error starting the syslog receiver: %v", err)
+		}
+		utils.Logger.Printf("Receiving syslog drains on: %s", receiver.listener.Addr())
+
+		return func(conn *connection, req *loggregator_v2.EgressBatchRequest) loggregator.EnvelopeStream {
+			return receiver.stream(conn.ctx)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("'%s' is not a valid RLP transport (%s, %s or %s)", conf.RLPTransport, transportGateway, transportGRPC, transportSyslog)
+}
+
+type tokenAttacher struct {
+	tokens uaa.UAA
+	client *http.Client
+	conn   *connection
+}
+
+func (a *tokenAttacher) Do(req *http.Request) (*http.Response, error) {
+	token, err := a.tokens.GetAuthToken()
+	if err != nil {
+		a.conn.close(reasonAuthError)
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", token)
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		a.conn.close(reasonRequestError)
+	}
+	return res, err
+}
@@ -0,0 +1,186 @@
+package nozzle
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/wavefront"
+	"github.com/wavefronthq/go-metrics-wavefront/reporting"
+)
+
+// rollupTags are the tags of the container metrics kept on the app rollups
+var rollupTags = []string{"source_id", "applicationName", "org", "space", "foundation"}
+
+type instanceKey struct {
+	sourceID   string
+	instanceID string
+}
+
+// instanceMetrics holds the latest container metrics of an app instance
+type instanceMetrics struct {
+	tags      map[string]string
+	cpu       float64
+	memory    float64
+	disk      float64
+	diskQuota float64
+	ts        int64
+	updated   bool
+}
+
+type appRollup struct {
+	tags      map[string]string
+	instances int
+	cpuSum    float64
+	cpuMax    float64
+	memory    float64
+	disk      float64
+	diskQuota float64
+	ts        int64
+}
+
+// appRollups sums the container metrics of the app instances, and sends the per app totals every interval.
+// It's shared by the workers, as the instances of an app are spread over all of them.
+type appRollups struct {
+	prefix string
+	wf     wavefront.Wavefront
+
+	mutex     sync.Mutex
+	instances map[instanceKey]*instanceMetrics
+
+	done chan struct{}
+}
+
+func newAppRollups(conf *config.Config, internalTags map[string]string) *appRollups {
+	ar := &appRollups{
+		prefix:    strings.Trim(conf.Wavefront.Prefix, " "),
+		wf:        wavefront.NewWavefront(conf.Wavefront, internalTags),
+		instances: make(map[instanceKey]*instanceMetrics),
+		done:      make(chan struct{}),
+	}
+	reporting.RegisterMetric("nozzle.rollups.instances", metrics.NewFunctionalGauge(ar.size), internalTags)
+	return ar
+}
+
+func (ar *appRollups) start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ar.flush()
+			case <-ar.done:
+				return
+			}
+		}
+	}()
+}
+
+// update keeps the container metrics of the envelope instance, tags are the envelope tags with the app tags
+func (ar *appRollups) update(event *loggregator_v2.Envelope, tags map[string]string, ts int64) {
+	key := instanceKey{sourceID: event.GetTags()["source_id"], instanceID: event.GetTags()["instance_id"]}
+	if len(key.sourceID) == 0 || len(key.instanceID) == 0 {
+		return
+	}
+
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	instance, ok := ar.instances[key]
+	if !ok {
+		instance = &instanceMetrics{tags: make(map[string]string, len(rollupTags))}
+		ar.instances[key] = instance
+	}
+	// the app tags show up once the apps cache knows the app
+	if len(instance.tags) < len(rollupTags) {
+		for _, k := range rollupTags {
+			if v := tags[k]; len(v) > 0 {
+				instance.tags[k] = v
+			}
+		}
+	}
+
+	for name, metric := range event.GetGauge().GetMetrics() {
+		switch name {
+		case "cpu":
+			instance.cpu = metric.GetValue()
+		case "memory":
+			instance.memory = metric.GetValue()
+		case "disk":
+			instance.disk = metric.GetValue()
+		case "disk_quota":
+			instance.diskQuota = metric.GetValue()
+		}
+	}
+	if ts > instance.ts {
+		instance.ts = ts
+	}
+	instance.updated = true
+}
+
+// flush sends the rollups of the instances updated since the previous flush, the other instances are gone
+func (ar *appRollups) flush() {
+	apps := make(map[string]*appRollup)
+
+	ar.mutex.Lock()
+	for key, instance := range ar.instances {
+		if !instance.updated {
+			delete(ar.instances, key)
+			continue
+		}
+		instance.updated = false
+
+		app, ok := apps[key.sourceID]
+		if !ok {
+			app = &appRollup{tags: utils.CopyTags(instance.tags)}
+			apps[key.sourceID] = app
+		}
+		app.instances++
+		app.cpuSum += instance.cpu
+		if instance.cpu > app.cpuMax {
+			app.cpuMax = instance.cpu
+		}
+		app.memory += instance.memory
+		app.disk += instance.disk
+		app.diskQuota += instance.diskQuota
+		if instance.ts > app.ts {
+			app.ts = instance.ts
+		}
+	}
+	ar.mutex.Unlock()
+
+	for sourceID, app := range apps {
+		source := app.tags["applicationName"]
+		if len(source) == 0 {
+			source = sourceID
+		}
+
+		ar.wf.SendMetric(ar.prefix+".app.instances", float64(app.instances), app.ts, source, app.tags)
+		ar.wf.SendMetric(ar.prefix+".app.memory_bytes", app.memory, app.ts, source, app.tags)
+		ar.wf.SendMetric(ar.prefix+".app.cpu_percentage.avg", app.cpuSum/float64(app.instances), app.ts, source, app.tags)
+		ar.wf.SendMetric(ar.prefix+".app.cpu_percentage.max", app.cpuMax, app.ts, source, app.tags)
+		ar.wf.SendMetric(ar.prefix+".app.disk_bytes", app.disk, app.ts, source, app.tags)
+		ar.wf.SendMetric(ar.prefix+".app.disk_bytes_quota", app.diskQuota, app.ts, source, app.tags)
+		if app.diskQuota > 0 {
+			ar.wf.SendMetric(ar.prefix+".app.disk_percentage", 100*app.disk/app.diskQuota, app.ts, source, app.tags)
+		}
+	}
+}
+
+func (ar *appRollups) size() int64 {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+	return int64(len(ar.instances))
+}
+
+// close sends the current rollups and closes the Wavefront senders
+func (ar *appRollups) close() {
+	close(ar.done)
+	ar.flush()
+	ar.wf.Close()
+}
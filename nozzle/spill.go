@@ -0,0 +1,131 @@
+package nozzle
+
+import (
+	"context"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/spill"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+	"github.com/wavefronthq/go-metrics-wavefront/reporting"
+)
+
+// spillBuffer takes the envelopes that don't fit on the events channel and replays them when the pressure drops
+type spillBuffer struct {
+	queue *spill.Queue
+
+	writes metrics.Counter
+	reads  metrics.Counter
+	drops  metrics.Counter
+	errors metrics.Counter
+}
+
+func newSpillBuffer(conf *config.NozzleConfig, internalTags map[string]string) (*spillBuffer, error) {
+	queue, err := spill.Open(conf.SpillDir, int64(conf.SpillMaxMb)*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	if queue.Len() > 0 {
+		utils.Logger.Printf("Found %d spilled envelopes from a previous run", queue.Len())
+	}
+
+	sb := &spillBuffer{
+		queue:  queue,
+		writes: metrics.NewCounter(),
+		reads:  metrics.NewCounter(),
+		drops:  metrics.NewCounter(),
+		errors: metrics.NewCounter(),
+	}
+
+	reporting.RegisterMetric("nozzle.spill.writes", sb.writes, internalTags)
+	reporting.RegisterMetric("nozzle.spill.reads", sb.reads, internalTags)
+	reporting.RegisterMetric("nozzle.spill.drops", sb.drops, internalTags)
+	reporting.RegisterMetric("nozzle.spill.errors", sb.errors, internalTags)
+	reporting.RegisterMetric("nozzle.spill.used", metrics.NewFunctionalGauge(queue.Len), internalTags)
+	reporting.RegisterMetric("nozzle.spill.bytes", metrics.NewFunctionalGauge(queue.Size), internalTags)
+	return sb, nil
+}
+
+// push writes the envelope to disk, returns false if it was dropped
+func (sb *spillBuffer) push(e *loggregator_v2.Envelope) bool {
+	data, err := proto.Marshal(e)
+	if err != nil {
+		sb.errors.Inc(1)
+		return false
+	}
+
+	err = sb.queue.Push(data)
+	if err != nil {
+		if err == spill.ErrFull {
+			sb.drops.Inc(1)
+		} else {
+			sb.errors.Inc(1)
+			if utils.Debug {
+				utils.Logger.Printf("[ERROR] error spilling envelope: %v", err)
+			}
+		}
+		return false
+	}
+	sb.writes.Inc(1)
+	return true
+}
+
+// replay moves the spilled envelopes to the events channel while it is less than half full
+func (sb *spillBuffer) replay(ctx context.Context, events chan *loggregator_v2.Envelope) {
+	wait := func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	for ctx.Err() == nil {
+		if len(events) > cap(events)/2 || sb.queue.Len() == 0 {
+			wait()
+			continue
+		}
+
+		data, err := sb.queue.Peek()
+		if err != nil {
+			if err != spill.ErrEmpty {
+				sb.errors.Inc(1)
+			}
+			wait()
+			continue
+		}
+
+		e := &loggregator_v2.Envelope{}
+		if err := proto.Unmarshal(data, e); err != nil {
+			sb.errors.Inc(1)
+			sb.discard()
+			continue
+		}
+
+		// the envelope stays on disk, in order, when the nozzle stops before it's enqueued
+		select {
+		case events <- e:
+			sb.reads.Inc(1)
+			sb.discard()
+		case <-ctx.Done():
+		}
+	}
+}
+
+// discard removes the replayed envelope from the disk
+func (sb *spillBuffer) discard() {
+	if err := sb.queue.Discard(); err != nil {
+		sb.errors.Inc(1)
+		if utils.Debug {
+			utils.Logger.Printf("[ERROR] error discarding a spilled envelope: %v", err)
+		}
+	}
+}
+
+func (sb *spillBuffer) close() {
+	if err := sb.queue.Close(); err != nil {
+		utils.Logger.Printf("[ERROR] error closing the spill buffer: %v", err)
+	}
+}
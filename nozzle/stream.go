@@ -0,0 +1,115 @@
+package nozzle
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// reasons why a RLP stream is closed and reconnected
+const (
+	reasonAuthError    = "auth_error"
+	reasonRequestError = "request_error"
+	reasonStall        = "stall"
+	reasonStreamClosed = "stream_closed"
+	reasonShutdown     = "shutdown"
+)
+
+// newReconnectCounters returns a counter for each reason a stream is reconnected
+func newReconnectCounters(internalTags map[string]string) map[string]metrics.Counter {
+	reconnects := make(map[string]metrics.Counter)
+	for _, reason := range []string{reasonAuthError, reasonRequestError, reasonStall, reasonStreamClosed} {
+		tags := utils.CopyTags(internalTags)
+		tags["reason"] = reason
+		reconnects[reason] = utils.NewCounter("nozzle.stream.reconnects", tags)
+	}
+	return reconnects
+}
+
+// connection tracks the lifetime of a RLP stream and the reason it was closed
+type connection struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	once         sync.Once
+	reason       string
+	lastEnvelope int64
+}
+
+func newConnection() *connection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connection{
+		ctx:          ctx,
+		cancel:       cancel,
+		lastEnvelope: time.Now().UnixNano(),
+	}
+}
+
+// close cancels the stream context, only the first reason is kept
+func (c *connection) close(reason string) {
+	c.once.Do(func() {
+		c.reason = reason
+		c.cancel()
+	})
+}
+
+// touch records that an envelope was received
+func (c *connection) touch() {
+	atomic.StoreInt64(&c.lastEnvelope, time.Now().UnixNano())
+}
+
+// watch closes the connection when no envelopes are received for 'timeout'
+func (c *connection) watch(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&c.lastEnvelope))
+			if time.Since(last) > timeout {
+				utils.Logger.Printf("[ERROR] No envelopes received in %v, the stream is stalled", timeout)
+				c.close(reasonStall)
+				return
+			}
+		}
+	}
+}
+
+// backoff computes exponential reconnection delays with jitter
+type backoff struct {
+	min      time.Duration
+	max      time.Duration
+	attempts int
+}
+
+// next returns a random delay between half and the full exponential delay for the current attempt
+func (b *backoff) next() time.Duration {
+	delay := b.min
+	for i := 0; i < b.attempts && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.attempts++
+
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func (b *backoff) reset() {
+	b.attempts = 0
+}
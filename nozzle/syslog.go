@@ -0,0 +1,205 @@
+package nozzle
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	loggregator "code.cloudfoundry.org/go-loggregator/v8"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/rcrowley/go-metrics"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/config"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/syslog"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+)
+
+// loggregator structured data ids
+const (
+	sdGauge   = "gauge@47450"
+	sdCounter = "counter@47450"
+	sdTags    = "tags@47450"
+)
+
+// syslogReceiver rebuilds the gauge and counter envelopes sent by loggregator syslog drains
+type syslogReceiver struct {
+	listener net.Listener
+	batches  chan []*loggregator_v2.Envelope
+
+	connections metrics.Counter
+	messages    metrics.Counter
+	invalid     metrics.Counter
+	ignored     metrics.Counter
+}
+
+func newSyslogReceiver(conf *config.NozzleConfig, internalTags map[string]string) (*syslogReceiver, error) {
+	var listener net.Listener
+	var err error
+
+	if len(conf.SyslogCertFile) > 0 || len(conf.SyslogKeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(conf.SyslogCertFile, conf.SyslogKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the syslog certificate: %v", err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if conf.TLS != nil {
+			tlsConfig.MinVersion = conf.TLS.MinVersion
+		}
+		listener, err = tls.Listen("tcp", conf.SyslogAddr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		listener, err = net.Listen("tcp", conf.SyslogAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := &syslogReceiver{
+		listener:    listener,
+		batches:     make(chan []*loggregator_v2.Envelope, 1000),
+		connections: utils.NewCounter("nozzle.syslog.connections", internalTags),
+		messages:    utils.NewCounter("nozzle.syslog.messages", internalTags),
+		invalid:     utils.NewCounter("nozzle.syslog.invalid", internalTags),
+		ignored:     utils.NewCounter("nozzle.syslog.ignored", internalTags),
+	}
+	go r.serve()
+	return r, nil
+}
+
+func (r *syslogReceiver) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			utils.Logger.Printf("[ERROR] syslog receiver stopped: %v", err)
+			return
+		}
+		r.connections.Inc(1)
+		go r.handle(conn)
+	}
+}
+
+// handle reads the messages of a drain connection, a slow queue slows down the drain
+func (r *syslogReceiver) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := syslog.ReadFrame(reader)
+		if err != nil {
+			if err != io.EOF && utils.Debug {
+				utils.Logger.Printf("[ERROR] error reading from syslog drain '%s': %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		msg, err := syslog.Parse(frame)
+		if err != nil {
+			r.invalid.Inc(1)
+			if utils.Debug {
+				utils.Logger.Printf("[ERROR] invalid syslog message: %v", err)
+			}
+			continue
+		}
+		r.messages.Inc(1)
+
+		envelopes := syslogEnvelopes(msg)
+		if len(envelopes) == 0 {
+			r.ignored.Inc(1)
+			continue
+		}
+		r.batches <- envelopes
+	}
+}
+
+// stream returns the received envelopes until ctx is done
+func (r *syslogReceiver) stream(ctx context.Context) loggregator.EnvelopeStream {
+	return func() []*loggregator_v2.Envelope {
+		select {
+		case batch := <-r.batches:
+			return batch
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// syslogEnvelopes converts the gauge and counter structured data of a message, other messages are ignored
+func syslogEnvelopes(msg *syslog.Message) []*loggregator_v2.Envelope {
+	tags := make(map[string]string)
+	if e, ok := msg.Element(sdTags); ok {
+		for k, v := range e.Params {
+			tags[k] = v
+		}
+	}
+	if _, ok := tags["source_id"]; !ok && len(msg.AppName) > 0 {
+		tags["source_id"] = msg.AppName
+	}
+
+	instanceID := strings.Trim(msg.ProcID, "[]")
+	if idx := strings.LastIndex(instanceID, "/"); idx >= 0 {
+		instanceID = instanceID[idx+1:]
+	}
+
+	// the timestamp is optional
+	ts := msg.Timestamp.UnixNano()
+	if msg.Timestamp.IsZero() {
+		ts = time.Now().UnixNano()
+	}
+
+	newEnvelope := func() *loggregator_v2.Envelope {
+		envTags := make(map[string]string, len(tags))
+		for k, v := range tags {
+			envTags[k] = v
+		}
+		return &loggregator_v2.Envelope{
+			Timestamp:  ts,
+			SourceId:   msg.AppName,
+			InstanceId: instanceID,
+			Tags:       envTags,
+		}
+	}
+
+	var envelopes []*loggregator_v2.Envelope
+	var gauge *loggregator_v2.Gauge
+	for _, e := range msg.StructuredData {
+		switch e.ID {
+		case sdGauge:
+			value, err := strconv.ParseFloat(e.Params["value"], 64)
+			if err != nil || len(e.Params["name"]) == 0 {
+				continue
+			}
+			if gauge == nil {
+				gauge = &loggregator_v2.Gauge{Metrics: make(map[string]*loggregator_v2.GaugeValue)}
+				env := newEnvelope()
+				env.Message = &loggregator_v2.Envelope_Gauge{Gauge: gauge}
+				envelopes = append(envelopes, env)
+			}
+			gauge.Metrics[e.Params["name"]] = &loggregator_v2.GaugeValue{Unit: e.Params["unit"], Value: value}
+
+		case sdCounter:
+			total, err := strconv.ParseUint(e.Params["total"], 10, 64)
+			if err != nil || len(e.Params["name"]) == 0 {
+				continue
+			}
+			delta, _ := strconv.ParseUint(e.Params["delta"], 10, 64)
+			env := newEnvelope()
+			env.Message = &loggregator_v2.Envelope_Counter{Counter: &loggregator_v2.Counter{
+				Name:  e.Params["name"],
+				Total: total,
+				Delta: delta,
+			}}
+			envelopes = append(envelopes, env)
+		}
+	}
+	return envelopes
+}
@@ -0,0 +1,110 @@
+package nozzle
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/utils"
+	"github.com/wavefronthq/cloud-foundry-nozzle-go/internal/wavefront"
+	"github.com/wavefronthq/wavefront-sdk-go/histogram"
+)
+
+// timerIdleExpiration is how long a timer series is kept without new samples
+const timerIdleExpiration = 5 * time.Minute
+
+type timerSeries struct {
+	name       string
+	source     string
+	tags       map[string]string
+	hist       histogram.Histogram
+	lastUpdate time.Time
+}
+
+// timerAggregator accumulates Timer durations into minute distributions
+type timerAggregator struct {
+	mutex  sync.Mutex
+	series map[string]*timerSeries
+	wf     wavefront.Wavefront
+	closed int32
+	done   chan struct{}
+}
+
+func newTimerAggregator(wf wavefront.Wavefront) *timerAggregator {
+	return &timerAggregator{
+		series: make(map[string]*timerSeries),
+		wf:     wf,
+		done:   make(chan struct{}),
+	}
+}
+
+func (ta *timerAggregator) start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ta.flush()
+			case <-ta.done:
+				return
+			}
+		}
+	}()
+}
+
+func (ta *timerAggregator) update(name string, value float64, source string, tags map[string]string) {
+	key := utils.SeriesKey(name, source, tags)
+
+	ta.mutex.Lock()
+	s, ok := ta.series[key]
+	if !ok {
+		s = &timerSeries{
+			name:   name,
+			source: source,
+			tags:   tags,
+			hist:   histogram.New(histogram.GranularityOption(histogram.MINUTE), histogram.TimeSupplier(ta.now)),
+		}
+		ta.series[key] = s
+	}
+	s.lastUpdate = time.Now()
+	ta.mutex.Unlock()
+
+	s.hist.Update(value)
+}
+
+// now moves the clock one minute ahead once closed, so the current minute is completed and flushed
+func (ta *timerAggregator) now() time.Time {
+	if atomic.LoadInt32(&ta.closed) == 1 {
+		return time.Now().Add(time.Minute)
+	}
+	return time.Now()
+}
+
+// close stops the periodic flushes, then flushes all the series, including the current minute
+func (ta *timerAggregator) close() {
+	close(ta.done)
+	atomic.StoreInt32(&ta.closed, 1)
+	ta.flush()
+}
+
+// flush sends the completed minute distributions and removes idle series
+func (ta *timerAggregator) flush() {
+	ta.mutex.Lock()
+	var ready []*timerSeries
+	for key, s := range ta.series {
+		ready = append(ready, s)
+		if time.Since(s.lastUpdate) > timerIdleExpiration {
+			delete(ta.series, key)
+		}
+	}
+	ta.mutex.Unlock()
+
+	for _, s := range ready {
+		for _, d := range s.hist.Distributions() {
+			if len(d.Centroids) > 0 {
+				ta.wf.SendDistribution(s.name, d.Centroids, d.Timestamp.Unix(), s.source, s.tags)
+			}
+		}
+	}
+}